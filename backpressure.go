@@ -0,0 +1,204 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agentmon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Backpressure is what a source does with a Batch when the Inbox is
+// full.
+type Backpressure int
+
+const (
+	// Block waits until there's room in the Inbox.
+	Block Backpressure = iota
+
+	// DropNewest drops the Batch that doesn't fit.
+	DropNewest
+
+	// DropOldest drops the oldest Batch in the Inbox to make room.
+	DropOldest
+
+	// Sample keeps 1 in SampleEvery of the Batches that don't fit,
+	// waiting for room for those, and drops the rest. The sample rate of
+	// kept counters and timers is scaled to account for those dropped.
+	Sample
+)
+
+// SampleEvery is how many Batches the Sample policy replaces with one.
+const SampleEvery = 10
+
+// DroppedMetricName is the Stats counter of Measurements dropped due to
+// Backpressure. It's tagged with the `source` and `policy`.
+const DroppedMetricName = "agentmon.dropped"
+
+var backpressureNames = map[Backpressure]string{
+	Block:      "block",
+	DropNewest: "drop-newest",
+	DropOldest: "drop-oldest",
+	Sample:     "sample",
+}
+
+func (b Backpressure) String() string {
+	if s, ok := backpressureNames[b]; ok {
+		return s
+	}
+	return fmt.Sprintf("Backpressure(%d)", int(b))
+}
+
+// ParseBackpressure returns the Backpressure named s: `block`,
+// `drop-newest`, `drop-oldest`, or `sample`.
+func ParseBackpressure(s string) (Backpressure, error) {
+	for b, name := range backpressureNames {
+		if s == name {
+			return b, nil
+		}
+	}
+	return Block, fmt.Errorf("unknown backpressure policy %q", s)
+}
+
+// Sender collects Measurements into Batches for an Inbox, applying a
+// Backpressure policy when it's full. A Sender isn't safe for
+// concurrent use.
+type Sender struct {
+	// Transform, if set, rewrites each Measurement as it's added.
+	Transform Transformer
+
+	inbox   chan *Batch
+	policy  Backpressure
+	dropped *StatCounter
+	full    uint64
+	batch   *Batch
+}
+
+// NewSender constructs a Sender for the named source. Measurements it
+// drops are counted in stats, which may be nil.
+func NewSender(inbox chan *Batch, policy Backpressure, stats *Stats, source string) *Sender {
+	return &Sender{
+		inbox:  inbox,
+		policy: policy,
+		dropped: stats.Counter(DroppedMetricName,
+			Tag{Key: "source", Value: source},
+			Tag{Key: "policy", Value: policy.String()}),
+	}
+}
+
+// Add adds a copy of m, after applying Transform, to the current Batch,
+// sending it once full. agentmon's own metrics, named agentmon.*, aren't
+// transformed. It returns false if ctx was done before the Batch could
+// be delivered.
+func (s *Sender) Add(ctx context.Context, m *Measurement) bool {
+	if s.batch == nil {
+		s.batch = NewBatch()
+	}
+	s.batch.Add(m)
+	if s.Transform != nil && !strings.HasPrefix(m.Name, "agentmon.") {
+		s.Transform.Transform(&s.batch.Measurements[s.batch.Len()-1])
+	}
+
+	if s.batch.Full() {
+		return s.Flush(ctx)
+	}
+	return true
+}
+
+// Flush sends the current Batch, if it has anything in it. Sources
+// should Flush whenever they run out of Measurements to Add for now.
+func (s *Sender) Flush(ctx context.Context) bool {
+	if s.batch == nil || s.batch.Len() == 0 {
+		return true
+	}
+
+	b := s.batch
+	s.batch = nil
+	return s.Send(ctx, b)
+}
+
+// Send delivers b according to the Sender's policy. It returns false
+// if ctx was done before b could be delivered.
+func (s *Sender) Send(ctx context.Context, b *Batch) bool {
+	select {
+	case s.inbox <- b:
+		return true
+	default:
+	}
+
+	switch s.policy {
+	case DropNewest:
+		s.drop(b)
+		return true
+
+	case DropOldest:
+		for dropping := true; dropping; {
+			select {
+			case old := <-s.inbox:
+				s.drop(old)
+			default:
+				// Nothing is buffered, so wait for room instead.
+				dropping = false
+			}
+
+			select {
+			case s.inbox <- b:
+				return true
+			default:
+			}
+		}
+
+	case Sample:
+		s.full++
+		if s.full%SampleEvery != 0 {
+			s.drop(b)
+			return true
+		}
+		for i := range b.Measurements {
+			m := &b.Measurements[i]
+			if m.Type == Counter || m.Type == Timer || m.Type == Histogram || m.Type == Distribution {
+				m.SampleRate /= SampleEvery
+			}
+		}
+	}
+
+	select {
+	case s.inbox <- b:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *Sender) drop(b *Batch) {
+	s.dropped.Add(uint64(b.Len()))
+	b.Release()
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agentmon
+
+import (
+	"context"
+	"testing"
+)
+
+func counter(name string, value float64) *Measurement {
+	return &Measurement{Name: name, Type: Counter, Value: value, SampleRate: 1}
+}
+
+// batchOf returns a Batch of a counter for each name.
+func batchOf(names ...string) *Batch {
+	b := NewBatch()
+	for _, name := range names {
+		b.Add(counter(name, 1))
+	}
+	return b
+}
+
+func TestParseBackpressure(t *testing.T) {
+	for _, b := range []Backpressure{Block, DropNewest, DropOldest, Sample} {
+		got, err := ParseBackpressure(b.String())
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got != b {
+			t.Errorf("got %s, want %s", got, b)
+		}
+	}
+
+	if _, err := ParseBackpressure("drop-everything"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
+
+func TestSenderBlock(t *testing.T) {
+	inbox := make(chan *Batch, 1)
+	s := NewSender(inbox, Block, nil, "test")
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if !s.Send(ctx, batchOf("first")) {
+		t.Fatal("expected the first send to succeed")
+	}
+
+	cancel()
+	if s.Send(ctx, batchOf("second")) {
+		t.Error("expected a full, blocked send to give up once cancelled")
+	}
+}
+
+func TestSenderDropNewest(t *testing.T) {
+	inbox := make(chan *Batch, 1)
+	stats := NewStats()
+	s := NewSender(inbox, DropNewest, stats, "test")
+
+	s.Send(context.Background(), batchOf("first"))
+	s.Send(context.Background(), batchOf("second", "third"))
+
+	if b := <-inbox; b.Measurements[0].Name != "first" {
+		t.Errorf("got %s, want first", b.Measurements[0].Name)
+	}
+	dropped := stats.Counter(DroppedMetricName,
+		Tag{Key: "source", Value: "test"}, Tag{Key: "policy", Value: "drop-newest"})
+	if dropped.Value() != 2 {
+		t.Errorf("got %d dropped, want 2", dropped.Value())
+	}
+}
+
+func TestSenderDropOldest(t *testing.T) {
+	inbox := make(chan *Batch, 2)
+	stats := NewStats()
+	s := NewSender(inbox, DropOldest, stats, "test")
+
+	for _, name := range []string{"first", "second", "third"} {
+		s.Send(context.Background(), batchOf(name))
+	}
+
+	if b := <-inbox; b.Measurements[0].Name != "second" {
+		t.Errorf("got %s, want second", b.Measurements[0].Name)
+	}
+	if b := <-inbox; b.Measurements[0].Name != "third" {
+		t.Errorf("got %s, want third", b.Measurements[0].Name)
+	}
+	dropped := stats.Counter(DroppedMetricName,
+		Tag{Key: "policy", Value: "drop-oldest"}, Tag{Key: "source", Value: "test"})
+	if dropped.Value() != 1 {
+		t.Errorf("got %d dropped, want 1", dropped.Value())
+	}
+}
+
+func TestSenderSample(t *testing.T) {
+	inbox := make(chan *Batch, 1)
+	stats := NewStats()
+	s := NewSender(inbox, Sample, stats, "test")
+
+	// Leave the Inbox full, so that each Send has to sample.
+	s.Send(context.Background(), batchOf("full"))
+	for i := 1; i < SampleEvery; i++ {
+		s.Send(context.Background(), batchOf("sampled"))
+	}
+
+	// The last of each SampleEvery is kept, and waits for room, standing
+	// in for those dropped.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b := batchOf("sampled")
+	if s.Send(ctx, b) {
+		t.Error("expected the kept batch to wait for room")
+	}
+	if m := b.Measurements[0]; m.SampleRate != 1.0/SampleEvery {
+		t.Errorf("got SampleRate=%f, want %f", m.SampleRate, 1.0/SampleEvery)
+	}
+	dropped := stats.Counter(DroppedMetricName,
+		Tag{Key: "source", Value: "test"}, Tag{Key: "policy", Value: "sample"})
+	if dropped.Value() != SampleEvery-1 {
+		t.Errorf("got %d dropped, want %d", dropped.Value(), SampleEvery-1)
+	}
+}
+
+func TestSenderAdd(t *testing.T) {
+	inbox := make(chan *Batch, 2)
+	s := NewSender(inbox, Block, nil, "test")
+	ctx := context.Background()
+
+	for i := 0; i < BatchSize+1; i++ {
+		s.Add(ctx, counter("added", 1))
+	}
+	if len(inbox) != 1 {
+		t.Fatalf("got %d batches, want 1 once full", len(inbox))
+	}
+	if b := <-inbox; b.Len() != BatchSize {
+		t.Errorf("got a batch of %d, want %d", b.Len(), BatchSize)
+	}
+
+	s.Flush(ctx)
+	s.Flush(ctx)
+	if len(inbox) != 1 {
+		t.Fatalf("got %d batches, want 1 for the remainder", len(inbox))
+	}
+	if b := <-inbox; b.Len() != 1 {
+		t.Errorf("got a batch of %d, want 1", b.Len())
+	}
+}
+
+func TestSenderTransform(t *testing.T) {
+	templates, err := ParseTemplates([]string{"app.* app.process.measurement"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	inbox := make(chan *Batch, 1)
+	s := NewSender(inbox, Block, nil, "test")
+	s.Transform = templates
+	ctx := context.Background()
+
+	m := counter("app.web.requests", 1)
+	s.Add(ctx, m)
+	s.Flush(ctx)
+
+	b := <-inbox
+	if got := b.Measurements[0].Name; got != "requests" {
+		t.Errorf("got name %q, want requests", got)
+	}
+	if len(b.Measurements[0].Tags) != 2 {
+		t.Errorf("got tags %v, want app and process", b.Measurements[0].Tags)
+	}
+	if m.Name != "app.web.requests" {
+		t.Errorf("expected the added measurement to be left alone, got %q", m.Name)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agentmon
+
+import "sync"
+
+// BatchSize is the number of Measurements a pooled Batch has room for
+// before it needs to grow.
+const BatchSize = 128
+
+// Batch is a group of Measurements sent between sources and reporters
+// at once, rather than one at a time. Batches are pooled: once done
+// with a Batch, its receiver should Release it.
+type Batch struct {
+	Measurements []Measurement
+}
+
+var batchPool = sync.Pool{
+	New: func() interface{} {
+		return &Batch{Measurements: make([]Measurement, 0, BatchSize)}
+	},
+}
+
+// NewBatch returns an empty Batch from the pool.
+func NewBatch() *Batch {
+	return batchPool.Get().(*Batch)
+}
+
+// Add appends a copy of m to the Batch.
+func (b *Batch) Add(m *Measurement) {
+	b.Measurements = append(b.Measurements, *m)
+}
+
+// Len returns the number of Measurements in the Batch.
+func (b *Batch) Len() int {
+	return len(b.Measurements)
+}
+
+// Full returns true if the Batch has reached BatchSize.
+func (b *Batch) Full() bool {
+	return len(b.Measurements) >= BatchSize
+}
+
+// Release empties the Batch and returns it to the pool. It must not be
+// used afterwards.
+func (b *Batch) Release() {
+	clear(b.Measurements)
+	b.Measurements = b.Measurements[:0]
+	batchPool.Put(b)
+}
+
+// UpdateBatch applies each Measurement in b to the MetricSet.
+func (ms *MetricSet) UpdateBatch(b *Batch) {
+	for i := range b.Measurements {
+		ms.Update(&b.Measurements[i])
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agentmon
+
+import "testing"
+
+func TestBatch(t *testing.T) {
+	b := NewBatch()
+	for i := 0; i < BatchSize; i++ {
+		if b.Full() {
+			t.Fatalf("Expected room for %d, full at %d", BatchSize, i)
+		}
+		b.Add(counter("requests", 1))
+	}
+	if !b.Full() || b.Len() != BatchSize {
+		t.Errorf("Expected a full batch of %d, got %d", BatchSize, b.Len())
+	}
+
+	set := NewMetricSet(nil)
+	set.UpdateBatch(b)
+	if got := set.Counters["requests"]; got != BatchSize {
+		t.Errorf("got %f, want %d", got, BatchSize)
+	}
+
+	b.Release()
+	if b := NewBatch(); b.Len() != 0 {
+		t.Errorf("Expected a new batch to be empty, got %d", b.Len())
+	}
+}
+
+func TestBatchAddCopies(t *testing.T) {
+	m := counter("requests", 1)
+	b := NewBatch()
+	b.Add(m)
+	m.Value = 2
+
+	if got := b.Measurements[0].Value; got != 1 {
+		t.Errorf("got %f, want 1", got)
+	}
+}
@@ -39,10 +39,15 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/heroku/agentmon"
+	"github.com/heroku/agentmon/graphite"
+	"github.com/heroku/agentmon/influx"
 	"github.com/heroku/agentmon/prom"
 	"github.com/heroku/agentmon/reporter"
 	"github.com/heroku/agentmon/statsd"
@@ -52,14 +57,60 @@ var (
 	showVersion   = flag.Bool("version", false, "print version string")
 	debug         = flag.Bool("debug", false, "debug mode is more verbose")
 	flushInterval = flag.Int("interval", 20, "Sink flush interval in seconds")
+	shutdownWait  = flag.Int("shutdown-timeout", 10, "Seconds to wait for the final flush when shutting down")
 	promURL       = flag.String("prom-url", "", "Prometheus URL")
 	promInterval  = flag.Int("prom-interval", 5, "Prometheus poll interval in seconds")
+	promPolicy    = flag.String("prom-backpressure", "drop-newest", "What to do with Prometheus measurements when the backlog is full: block, drop-newest, drop-oldest, or sample")
+	statsdPolicy  = flag.String("statsd-backpressure", "block", "What to do with statsd measurements when the backlog is full: block, drop-newest, drop-oldest, or sample")
 	statsdAddr    = flag.String("statsd-addr", "", "UDP port for statsd listener")
-	bufferSize    = flag.Int("backlog", 1000, "Size of pending measurement buffer")
+	statsdTCPAddr = flag.String("statsd-tcp-addr", "", "TCP address for statsd listener")
+	statsdSocket  = flag.String("statsd-socket", "", "Unix socket path for statsd listener")
+	socketType    = flag.String("statsd-socket-type", "unixgram", "Unix socket type for statsd listener: unixgram, or unix")
+	socketMode    = flag.String("statsd-socket-mode", "", "Octal file mode for the statsd Unix socket")
+	socketOwner   = flag.String("statsd-socket-owner", "", "User to own the statsd Unix socket")
+	socketGroup   = flag.String("statsd-socket-group", "", "Group to own the statsd Unix socket")
+	socketOrigin  = flag.Bool("statsd-origin-detection", false, "Tag statsd Unix socket measurements with the sender's pid and process name (Linux only)")
+	udpReaders    = flag.Int("statsd-readers", 1, "Number of UDP sockets reading statsd datagrams (more than 1 is Linux only)")
+	udpRcvBuf     = flag.Int("statsd-rcvbuf", 0, "Receive buffer size in bytes for statsd UDP sockets (default is the OS's)")
+	maxPacketSize = flag.Int("statsd-max-packet-size", 0, "Largest statsd datagram accepted, up to 65535 for UDP (default 1472 for UDP, 8192 for Unix datagrams)")
+	logMalformed  = flag.Int("statsd-log-malformed", 0, "Log at most one malformed statsd line every N seconds (0 disables)")
+	bufferSize    = flag.Int("backlog", 64, "Size of each source's queue of pending measurement batches, of up to 128 measurements each")
+	promWeight    = flag.Int("prom-weight", 1, "Weight of the Prometheus queue when sources compete for the reporter")
+	statsdWeight  = flag.Int("statsd-weight", 1, "Weight of the statsd queue when sources compete for the reporter")
+	quantiles     = flag.String("quantiles", "0.5,0.95,0.99", "Comma separated quantiles to report for timers")
+	histQuantiles = flag.String("prom-histogram-quantiles", "", "Comma separated quantiles to estimate, as gauges, for Prometheus histograms")
+	sumQuantiles  = flag.String("prom-summary-quantiles", "", "Comma separated quantiles of Prometheus summaries to report as gauges, or none (default all)")
+	untypedTypes  = flag.String("prom-untyped-types", "", "Comma separated name=type pairs typing untyped Prometheus metrics as counter or gauge (default counter for names ending in _total, otherwise gauge)")
+	byTimestamp   = flag.Bool("bucket-by-timestamp", false, "Aggregate measurements into the interval of their timestamp, rather than the one they arrive in")
+	lateness      = flag.Int("lateness", 10, "Seconds to keep an interval open for late measurements, with -bucket-by-timestamp")
 )
 
+var (
+	graphiteAddr   = flag.String("graphite-addr", "", "TCP and UDP address for Graphite plaintext listener")
+	graphiteTypes  = flag.String("graphite-types", "", "Comma separated pattern=type pairs typing matching Graphite metrics as counter, derived, gauge, or timer (default gauge)")
+	graphitePolicy = flag.String("graphite-backpressure", "block", "What to do with Graphite measurements when the backlog is full: block, drop-newest, drop-oldest, or sample")
+	graphiteWeight = flag.Int("graphite-weight", 1, "Weight of the Graphite queue when sources compete for the reporter")
+)
+
+var (
+	influxAddr   = flag.String("influx-addr", "", "UDP and HTTP address for InfluxDB line protocol listener")
+	influxPolicy = flag.String("influx-backpressure", "block", "What to do with InfluxDB measurements when the backlog is full: block, drop-newest, drop-oldest, or sample")
+	influxWeight = flag.Int("influx-weight", 1, "Weight of the InfluxDB queue when sources compete for the reporter")
+)
+
+// templates are name templates applied to statsd and Graphite
+// measurements, given by repeating -template.
+var templates stringsFlag
+
+func init() {
+	flag.Var(&templates, "template", "Name template turning dotted statsd and Graphite names into a name and tags: [filter] template [tag=value,...] (may be repeated; the first to match applies)")
+}
+
 const measurementBufferSize = 1000
 
+// stats are agentmon's own metrics, reported along with everything else.
+var stats = agentmon.NewStats()
+
 func main() {
 	log.SetPrefix("agentmon: ")
 	log.SetFlags(0)
@@ -85,14 +136,20 @@ func main() {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
 
+	// Sources are stopped before the reporter, so that it can flush
+	// everything they sent.
 	ctx, cancel := context.WithCancel(context.Background())
+	qctx, qcancel := context.WithCancel(context.Background())
+	rctx, rcancel := context.WithCancel(context.Background())
+	var sources, queues, reporters sync.WaitGroup
 
-	// For statsd, default to :$PORT, if not specified.
-	if port := os.Getenv("PORT"); *statsdAddr == "" && port != "" {
+	// For statsd, default to :$PORT, if no other listener is specified.
+	noStatsd := *statsdAddr == "" && *statsdTCPAddr == "" && *statsdSocket == ""
+	if port := os.Getenv("PORT"); noStatsd && port != "" {
 		*statsdAddr = ":" + port
 	}
 
-	if *promURL == "" && *statsdAddr == "" {
+	if *promURL == "" && *statsdAddr == "" && *statsdTCPAddr == "" && *statsdSocket == "" && *graphiteAddr == "" && *influxAddr == "" {
 		log.Fatal("Nothing to start. Exiting.")
 	}
 
@@ -104,17 +161,45 @@ func main() {
 		}
 	}
 
-	inbox := make(chan *agentmon.Measurement, *bufferSize)
+	// Each source gets a queue of its own, so that none can crowd out
+	// the others.
+	inbox := make(chan *agentmon.Batch)
+	mux := agentmon.NewMux(inbox, stats)
 
 	if *promURL != "" {
-		startPromPoller(ctx, *promURL, inbox, *debug)
+		promInbox := mux.Source("prom", *bufferSize, *promWeight)
+		startPromPoller(ctx, &sources, *promURL, promInbox, *debug)
 	}
-	if *statsdAddr != "" {
-		startStatsdListener(ctx, *statsdAddr, inbox, *debug)
+	if *statsdAddr != "" || *statsdTCPAddr != "" || *statsdSocket != "" {
+		statsdInbox := mux.Source("statsd", *bufferSize, *statsdWeight)
+		if *statsdAddr != "" {
+			startStatsdListener(ctx, &sources, *statsdAddr, statsdInbox, *debug)
+		}
+		if *statsdTCPAddr != "" {
+			startStatsdTCPListener(ctx, &sources, *statsdTCPAddr, statsdInbox, *debug)
+		}
+		if *statsdSocket != "" {
+			startStatsdSocketListener(ctx, &sources, *statsdSocket, statsdInbox, *debug)
+		}
+	}
+	if *graphiteAddr != "" {
+		graphiteInbox := mux.Source("graphite", *bufferSize, *graphiteWeight)
+		startGraphiteListener(ctx, &sources, *graphiteAddr, graphiteInbox, *debug)
+	}
+	if *influxAddr != "" {
+		influxInbox := mux.Source("influx", *bufferSize, *influxWeight)
+		startInfluxListener(ctx, &sources, *influxAddr, influxInbox, *debug)
 	}
 
-	startReporter(ctx, time.Duration(*flushInterval)*time.Second, rURL, inbox, *debug)
+	goWait(&queues, func() { mux.Run(qctx) })
+	startReporter(rctx, &reporters, time.Duration(*flushInterval)*time.Second, rURL, inbox, *debug)
 	handleSignals(sigs, cancel)
+
+	sources.Wait()
+	qcancel()
+	queues.Wait()
+	rcancel()
+	reporters.Wait()
 }
 
 func handleSignals(sigs chan os.Signal, cancel func()) {
@@ -123,38 +208,232 @@ func handleSignals(sigs chan os.Signal, cancel func()) {
 		log.Printf("Got signal %s. Shutting down.\n", s)
 		cancel()
 	}
+
+	// Don't make anyone wait on a shutdown they want to skip.
+	go func() {
+		s := <-sigs
+		log.Fatalf("Got signal %s. Exiting now.", s)
+	}()
+}
+
+// goWait runs fn in a goroutine that wg waits for.
+func goWait(wg *sync.WaitGroup, fn func()) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fn()
+	}()
 }
 
-func startReporter(ctx context.Context, i time.Duration, rURL string, inbox chan *agentmon.Measurement, debug bool) {
+func startReporter(ctx context.Context, wg *sync.WaitGroup, i time.Duration, rURL string, inbox chan *agentmon.Batch, debug bool) {
+	qs, err := parseQuantiles(*quantiles)
+	if err != nil {
+		log.Fatalf("Invalid quantiles: %s", err)
+	}
+
 	reporter := reporter.Heroku{
-		URL:      rURL,
-		Interval: i,
-		Inbox:    inbox,
-		Debug:    debug,
+		URL:               rURL,
+		Interval:          i,
+		Inbox:             inbox,
+		Quantiles:         qs,
+		Stats:             stats,
+		ShutdownTimeout:   time.Duration(*shutdownWait) * time.Second,
+		BucketByTimestamp: *byTimestamp,
+		Lateness:          time.Duration(*lateness) * time.Second,
+		Debug:             debug,
+	}
+	goWait(wg, func() { reporter.Report(ctx) })
+}
+
+// parseTemplates returns the Transformer for -template, or nil if there
+// are none.
+func parseTemplates() agentmon.Transformer {
+	if len(templates) == 0 {
+		return nil
+	}
+	ts, err := agentmon.ParseTemplates(templates)
+	if err != nil {
+		log.Fatalf("Invalid template: %s", err)
+	}
+	return ts
+}
+
+// stringsFlag is a flag that may be given more than once.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func parseQuantiles(s string) ([]float64, error) {
+	out := []float64{}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		q, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return nil, err
+		}
+		if q < 0 || q > 1 {
+			return nil, fmt.Errorf("%s is not between 0 and 1", f)
+		}
+		out = append(out, q)
 	}
-	go reporter.Report(ctx)
+	return out, nil
 }
 
-func startPromPoller(ctx context.Context, u string, inbox chan *agentmon.Measurement, debug bool) {
+func parseBackpressure(s string) agentmon.Backpressure {
+	b, err := agentmon.ParseBackpressure(s)
+	if err != nil {
+		log.Fatalf("Invalid backpressure: %s", err)
+	}
+	return b
+}
+
+func startPromPoller(ctx context.Context, wg *sync.WaitGroup, u string, inbox chan *agentmon.Batch, debug bool) {
 	pu, err := url.Parse(u)
 	if err != nil {
 		log.Fatalf("Invalid Prometheus URL: %s", err)
 	}
+	qs, err := parseQuantiles(*histQuantiles)
+	if err != nil {
+		log.Fatalf("Invalid Prometheus histogram quantiles: %s", err)
+	}
+	var sqs []float64
+	if *sumQuantiles == "none" {
+		sqs = []float64{}
+	} else if *sumQuantiles != "" {
+		if sqs, err = parseQuantiles(*sumQuantiles); err != nil {
+			log.Fatalf("Invalid Prometheus summary quantiles: %s", err)
+		}
+	}
+	types, err := prom.ParseUntypedTypes(*untypedTypes)
+	if err != nil {
+		log.Fatalf("Invalid Prometheus untyped types: %s", err)
+	}
 
 	poller := prom.Poller{
-		URL:      pu,
-		Interval: time.Duration(*promInterval) * time.Second,
-		Inbox:    inbox,
-		Debug:    debug,
+		URL:                pu,
+		Interval:           time.Duration(*promInterval) * time.Second,
+		Inbox:              inbox,
+		Backpressure:       parseBackpressure(*promPolicy),
+		Stats:              stats,
+		HistogramQuantiles: qs,
+		SummaryQuantiles:   sqs,
+		UntypedTypes:       types,
+		Debug:              debug,
+	}
+	goWait(wg, func() { poller.Poll(ctx) })
+}
+
+func startStatsdListener(ctx context.Context, wg *sync.WaitGroup, a string, inbox chan *agentmon.Batch, debug bool) {
+	listener := statsd.Listener{
+		Addr:          a,
+		MaxPacketSize: int64(*maxPacketSize),
+		Readers:       *udpReaders,
+		ReceiveBuffer: *udpRcvBuf,
+		Inbox:         inbox,
+		Backpressure:  parseBackpressure(*statsdPolicy),
+		Transform:     parseTemplates(),
+		Stats:         stats,
+		Debug:         debug,
+
+		MalformedLogInterval: time.Duration(*logMalformed) * time.Second,
+	}
+	if debug {
+		listener.Events = statsd.LogEvents
+	}
+	goWait(wg, func() { listener.ListenUDP(ctx) })
+}
+
+func startStatsdTCPListener(ctx context.Context, wg *sync.WaitGroup, a string, inbox chan *agentmon.Batch, debug bool) {
+	listener := statsd.Listener{
+		Addr:         a,
+		Inbox:        inbox,
+		Backpressure: parseBackpressure(*statsdPolicy),
+		Transform:    parseTemplates(),
+		Stats:        stats,
+		Debug:        debug,
+
+		MalformedLogInterval: time.Duration(*logMalformed) * time.Second,
+	}
+	if debug {
+		listener.Events = statsd.LogEvents
 	}
-	go poller.Poll(ctx)
+	goWait(wg, func() { listener.ListenTCP(ctx) })
 }
 
-func startStatsdListener(ctx context.Context, a string, inbox chan *agentmon.Measurement, debug bool) {
+func startStatsdSocketListener(ctx context.Context, wg *sync.WaitGroup, path string, inbox chan *agentmon.Batch, debug bool) {
 	listener := statsd.Listener{
-		Addr:  a,
-		Inbox: inbox,
-		Debug: debug,
+		Addr:            path,
+		Inbox:           inbox,
+		Backpressure:    parseBackpressure(*statsdPolicy),
+		Transform:       parseTemplates(),
+		Stats:           stats,
+		SocketOwner:     *socketOwner,
+		SocketGroup:     *socketGroup,
+		OriginDetection: *socketOrigin,
+		MaxPacketSize:   int64(*maxPacketSize),
+		Debug:           debug,
+
+		MalformedLogInterval: time.Duration(*logMalformed) * time.Second,
+	}
+	if debug {
+		listener.Events = statsd.LogEvents
+	}
+
+	if *socketMode != "" {
+		mode, err := strconv.ParseUint(*socketMode, 8, 32)
+		if err != nil {
+			log.Fatalf("Invalid statsd socket mode: %s", err)
+		}
+		listener.SocketMode = os.FileMode(mode)
+	}
+
+	switch *socketType {
+	case "unixgram":
+		goWait(wg, func() { listener.ListenUnixgram(ctx) })
+	case "unix":
+		goWait(wg, func() { listener.ListenUnix(ctx) })
+	default:
+		log.Fatalf("Invalid statsd socket type: %q", *socketType)
+	}
+}
+
+func startGraphiteListener(ctx context.Context, wg *sync.WaitGroup, a string, inbox chan *agentmon.Batch, debug bool) {
+	mappings, err := graphite.ParseMappings(*graphiteTypes)
+	if err != nil {
+		log.Fatalf("Invalid Graphite types: %s", err)
+	}
+
+	listener := graphite.Listener{
+		Addr:         a,
+		Mappings:     mappings,
+		Inbox:        inbox,
+		Backpressure: parseBackpressure(*graphitePolicy),
+		Transform:    parseTemplates(),
+		Stats:        stats,
+		Debug:        debug,
+	}
+	goWait(wg, func() { listener.ListenTCP(ctx) })
+	goWait(wg, func() { listener.ListenUDP(ctx) })
+}
+
+func startInfluxListener(ctx context.Context, wg *sync.WaitGroup, a string, inbox chan *agentmon.Batch, debug bool) {
+	listener := influx.Listener{
+		Addr:         a,
+		Inbox:        inbox,
+		Backpressure: parseBackpressure(*influxPolicy),
+		Stats:        stats,
+		Debug:        debug,
 	}
-	go listener.ListenUDP(ctx)
+	goWait(wg, func() { listener.ListenUDP(ctx) })
+	goWait(wg, func() { listener.ListenHTTP(ctx) })
 }
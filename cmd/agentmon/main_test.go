@@ -36,6 +36,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
@@ -69,15 +70,16 @@ func TestMainStatsdEndToEnd(t *testing.T) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	inbox := make(chan *agentmon.Measurement, 100)
+	inbox := make(chan *agentmon.Batch, 100)
 	found := make(chan string, 1)
 
 	handler := makeTestHandler(t, found)
 	testServer := httptest.NewServer(handler)
 	defer testServer.Close()
 
-	startReporter(ctx, 100*time.Millisecond, testServer.URL, inbox, false)
-	startStatsdListener(ctx, addr, inbox, false)
+	var wg sync.WaitGroup
+	startReporter(ctx, &wg, 100*time.Millisecond, testServer.URL, inbox, false)
+	startStatsdListener(ctx, &wg, addr, inbox, false)
 
 	// Wait for Listener to come online.
 	time.Sleep(100 * time.Millisecond)
@@ -103,3 +105,62 @@ func TestMainStatsdEndToEnd(t *testing.T) {
 	}
 	cancel()
 }
+
+func TestMainShutdownFlush(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	rctx, rcancel := context.WithCancel(context.Background())
+	var sources, reporters sync.WaitGroup
+
+	inbox := make(chan *agentmon.Batch, 100)
+	found := make(chan string, 10)
+
+	testServer := httptest.NewServer(makeTestHandler(t, found))
+	defer testServer.Close()
+
+	// The interval is long enough that only the final flush happens.
+	startReporter(rctx, &reporters, time.Hour, testServer.URL, inbox, false)
+
+	// A source that only sends as it's being stopped.
+	goWait(&sources, func() {
+		<-ctx.Done()
+		b := agentmon.NewBatch()
+		b.Add(&agentmon.Measurement{Name: "gorets", Type: agentmon.Counter, Value: 1, SampleRate: 1})
+		inbox <- b
+	})
+
+	cancel()
+	sources.Wait()
+	rcancel()
+	reporters.Wait()
+
+	select {
+	case m := <-found:
+		if m != "gorets" {
+			t.Errorf("got %s, want %s", m, "gorets")
+		}
+	default:
+		t.Errorf("no metric flushed on shutdown")
+	}
+}
+
+func TestParseQuantiles(t *testing.T) {
+	got, err := parseQuantiles("0.5, 0.99,0.999")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := []float64{0.5, 0.99, 0.999}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	for _, bad := range []string{"1.5", "-0.1", "p99"} {
+		if _, err := parseQuantiles(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
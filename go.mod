@@ -7,6 +7,7 @@ require (
 	github.com/prometheus/client_golang v1.14.0
 	github.com/prometheus/client_model v0.6.2
 	github.com/prometheus/common v0.39.0
+	golang.org/x/sys v0.3.0
 )
 
 require (
@@ -14,6 +15,5 @@ require (
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/prometheus/procfs v0.8.0 // indirect
-	golang.org/x/sys v0.3.0 // indirect
 	google.golang.org/protobuf v1.36.6 // indirect
 )
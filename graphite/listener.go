@@ -0,0 +1,276 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package graphite
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/heroku/agentmon"
+	"github.com/heroku/agentmon/internal/netutil"
+)
+
+const (
+	maxPacketSizeUDP     = 65535
+	defaultMaxLineLength = 64 * 1024
+	defaultIdleTimeout   = 5 * time.Minute
+)
+
+// MalformedMetricName is the name of the counter of lines that failed to
+// parse.
+const MalformedMetricName = "agentmon.graphite.malformed"
+
+// Listener defines the parameters needed to accept Graphite plaintext
+// protocol lines, `path value [timestamp]`, over TCP and UDP.
+type Listener struct {
+	// Addr is the address to be used for listening for TCP connections,
+	// and UDP datagrams.
+	Addr string
+
+	// Mappings give metrics matching their patterns a type other than
+	// agentmon.Gauge. The first to match wins.
+	Mappings []Mapping
+
+	// MaxLineLength is the longest line accepted over TCP. Connections
+	// sending longer lines are closed. Defaults to 64KiB.
+	MaxLineLength int
+
+	// IdleTimeout is how long a TCP connection may go without sending
+	// anything before it's closed. Defaults to 5 minutes.
+	IdleTimeout time.Duration
+
+	// Inbox is the channel to use to observe Batches of incoming
+	// measurements.
+	Inbox chan *agentmon.Batch
+
+	// Backpressure is what's done with measurements that don't fit in
+	// the Inbox. Defaults to agentmon.Block.
+	Backpressure agentmon.Backpressure
+
+	// Transform, if set, rewrites each measurement, e.g. with name
+	// Templates, before it's sent to the Inbox.
+	Transform agentmon.Transformer
+
+	// Stats, if set, counts the measurements dropped due to
+	// Backpressure, and the lines that fail to parse.
+	Stats *agentmon.Stats
+
+	// Debug is used to turn on extended logging, useful for debugging
+	// purposes.
+	Debug bool
+}
+
+// ListenTCP accepts TCP connections on Addr, each of which is expected
+// to send newline separated lines. Connections are closed, and
+// ListenTCP returns, once ctx is cancelled.
+func (s Listener) ListenTCP(ctx context.Context) {
+	log.Printf("Listening on %s (graphite tcp)...", s.Addr)
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		log.Fatalf("graphite: listenTCP: %s", err)
+	}
+
+	s.serveTCP(ctx, listener)
+}
+
+func (s Listener) serveTCP(ctx context.Context, listener net.Listener) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				if s.Debug {
+					log.Println("debug: stopping graphite tcp listener")
+				}
+				return
+			}
+			log.Printf("graphite: accept: %s", err)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleConn(ctx, conn)
+		}()
+	}
+}
+
+func (s Listener) handleConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	if s.IdleTimeout == 0 {
+		s.IdleTimeout = defaultIdleTimeout
+	}
+	if s.MaxLineLength == 0 {
+		s.MaxLineLength = defaultMaxLineLength
+	}
+
+	if s.Debug {
+		log.Printf("debug: handling graphite connection from %s", conn.RemoteAddr())
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	r := bufio.NewReaderSize(&netutil.ConnReader{Conn: conn, Timeout: s.IdleTimeout}, s.MaxLineLength)
+	sender := s.newSender()
+	malformed := s.Stats.Counter(MalformedMetricName)
+
+	var m agentmon.Measurement
+	for {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			log.Printf("graphite: closing connection from %s: line longer than %d bytes", conn.RemoteAddr(), s.MaxLineLength)
+			sender.Flush(ctx)
+			return
+		}
+
+		if s.parse(line, &m, malformed) && !sender.Add(ctx, &m) {
+			return
+		}
+
+		// Send what there is before waiting on the connection.
+		if r.Buffered() == 0 && !sender.Flush(ctx) {
+			return
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("graphite: read: %s", err)
+			}
+			return
+		}
+	}
+}
+
+// ListenUDP reads datagrams of newline separated lines sent to Addr
+// until ctx is cancelled.
+func (s Listener) ListenUDP(ctx context.Context) {
+	log.Printf("Listening on %s (graphite udp)...", s.Addr)
+	conn, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		log.Fatalf("graphite: listenUDP: %s", err)
+	}
+
+	s.serveUDP(ctx, conn)
+}
+
+func (s Listener) serveUDP(ctx context.Context, conn net.PacketConn) {
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	sender := s.newSender()
+	malformed := s.Stats.Counter(MalformedMetricName)
+	buf := make([]byte, maxPacketSizeUDP)
+
+	var m agentmon.Measurement
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				if s.Debug {
+					log.Println("debug: stopping graphite udp listener")
+				}
+				return
+			}
+			log.Printf("graphite: read: %s", err)
+			continue
+		}
+
+		for packet := buf[:n]; len(packet) > 0; {
+			line := packet
+			if i := bytes.IndexByte(packet, '\n'); i >= 0 {
+				line, packet = packet[:i], packet[i+1:]
+			} else {
+				packet = nil
+			}
+
+			if s.parse(line, &m, malformed) && !sender.Add(ctx, &m) {
+				return
+			}
+		}
+
+		if !sender.Flush(ctx) {
+			return
+		}
+	}
+}
+
+// parse parses line into m, returning false if there's nothing to send,
+// because line is empty, or doesn't parse.
+func (s Listener) parse(line []byte, m *agentmon.Measurement, malformed *agentmon.StatCounter) bool {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return false
+	}
+
+	if err := parseLine(line, s.Mappings, time.Now(), m); err != nil {
+		malformed.Add(1)
+		if s.Debug {
+			log.Printf("debug: graphite: %s", err)
+		}
+		return false
+	}
+	return true
+}
+
+// newSender returns a Sender to the Inbox that applies Backpressure,
+// and Transform.
+func (s Listener) newSender() *agentmon.Sender {
+	sender := agentmon.NewSender(s.Inbox, s.Backpressure, s.Stats, "graphite")
+	sender.Transform = s.Transform
+	return sender
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package graphite
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	am "github.com/heroku/agentmon"
+	"github.com/heroku/agentmon/internal/testutil"
+)
+
+func TestListenTCP(t *testing.T) {
+	batches, inbox := testutil.Inbox(t, 10)
+	stats := am.NewStats()
+	listener := Listener{Inbox: batches, Stats: stats}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		listener.serveTCP(ctx, l)
+	}()
+	defer wg.Wait()
+	defer cancel()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("web.load 1 1400000000\nweb.bad\nweb.mem 2"))
+	conn.Write([]byte("048 1400000000\r\n"))
+	testutil.ExpectValue(t, inbox, "web.load", 1)
+	testutil.ExpectValue(t, inbox, "web.mem", 2048)
+
+	if n := stats.Counter(MalformedMetricName).Value(); n != 1 {
+		t.Errorf("Expected 1 malformed line, got %d", n)
+	}
+}
+
+func TestListenTCPLongLine(t *testing.T) {
+	batches, _ := testutil.Inbox(t, 10)
+	listener := Listener{Inbox: batches, MaxLineLength: 64}
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		listener.handleConn(context.Background(), server)
+	}()
+
+	go client.Write([]byte("web." + strings.Repeat("x", 100) + " 1\n"))
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the connection to be closed after an overlong line")
+	}
+	client.Close()
+}
+
+func TestListenUDP(t *testing.T) {
+	batches, inbox := testutil.Inbox(t, 10)
+	listener := Listener{
+		Inbox:    batches,
+		Mappings: []Mapping{{Pattern: "*.requests", Type: am.Counter}},
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		listener.serveUDP(ctx, conn)
+	}()
+	defer wg.Wait()
+	defer cancel()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer client.Close()
+
+	client.Write([]byte("web.requests 3 1400000000\n\nweb.load 0.5"))
+
+	select {
+	case m := <-inbox:
+		if m.Name != "web.requests" || m.Type != am.Counter {
+			t.Errorf("Expected the web.requests counter, got %+v", m)
+		}
+		if !m.Timestamp.Equal(time.Unix(1400000000, 0)) {
+			t.Errorf("Expected the supplied timestamp, got %v", m.Timestamp)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a measurement for web.requests")
+	}
+	testutil.ExpectValue(t, inbox, "web.load", 0.5)
+}
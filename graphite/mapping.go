@@ -0,0 +1,103 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package graphite
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/heroku/agentmon"
+)
+
+// Mapping gives metrics whose path matches Pattern the type Type,
+// rather than the default of agentmon.Gauge.
+//
+// Patterns are matched a dotted segment at a time with
+// agentmon.MatchName, and must match the whole path, so `*.requests.*`
+// matches `web.requests.count` but not `web.requests`, or
+// `web.api.requests.count`.
+type Mapping struct {
+	Pattern string
+	Type    agentmon.MetricType
+}
+
+var mappingTypes = map[string]agentmon.MetricType{
+	"counter": agentmon.Counter,
+	"derived": agentmon.DerivedCounter,
+	"gauge":   agentmon.Gauge,
+	"timer":   agentmon.Timer,
+}
+
+// ParseMappings parses comma separated `pattern=type` pairs, where type
+// is one of counter, derived, gauge, or timer.
+func ParseMappings(s string) ([]Mapping, error) {
+	var out []Mapping
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		i := strings.LastIndexByte(pair, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("expected `pattern=type`, got %q", pair)
+		}
+		pattern, typ := pair[:i], pair[i+1:]
+
+		t, ok := mappingTypes[typ]
+		if !ok {
+			return nil, fmt.Errorf("unknown type %q for %q", typ, pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %s", pattern, err)
+		}
+		out = append(out, Mapping{Pattern: pattern, Type: t})
+	}
+	return out, nil
+}
+
+// matches returns true if all of name matches the Mapping's Pattern.
+func (m Mapping) matches(name string) bool {
+	rest, ok := agentmon.MatchName(m.Pattern, name)
+	return ok && rest == ""
+}
+
+// typeOf returns the type of the first of mappings to match name, or
+// agentmon.Gauge if none do.
+func typeOf(mappings []Mapping, name string) agentmon.MetricType {
+	for _, m := range mappings {
+		if m.matches(name) {
+			return m.Type
+		}
+	}
+	return agentmon.Gauge
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package graphite
+
+import (
+	"testing"
+
+	am "github.com/heroku/agentmon"
+)
+
+func TestParseMappings(t *testing.T) {
+	mappings, err := ParseMappings("*.requests.*=counter, stats.*.hits=derived,*.latency=timer,web.load=gauge")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expected := []Mapping{
+		{Pattern: "*.requests.*", Type: am.Counter},
+		{Pattern: "stats.*.hits", Type: am.DerivedCounter},
+		{Pattern: "*.latency", Type: am.Timer},
+		{Pattern: "web.load", Type: am.Gauge},
+	}
+	if len(mappings) != len(expected) {
+		t.Fatalf("Expected %d mappings, got %v", len(expected), mappings)
+	}
+	for i := range expected {
+		if mappings[i] != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], mappings[i])
+		}
+	}
+
+	for _, input := range []string{"*.requests", "*.requests=histogram", "[.x=counter"} {
+		if _, err := ParseMappings(input); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+}
+
+func TestTypeOf(t *testing.T) {
+	mappings := []Mapping{
+		{Pattern: "*.requests.*", Type: am.Counter},
+		{Pattern: "web.req*.count", Type: am.DerivedCounter},
+	}
+
+	for name, typ := range map[string]am.MetricType{
+		"web.requests.count":     am.Counter,
+		"web.requests":           am.Gauge,
+		"web.api.requests.count": am.Gauge,
+		"web.reqs.count":         am.DerivedCounter,
+		"web.load":               am.Gauge,
+	} {
+		if got := typeOf(mappings, name); got != typ {
+			t.Errorf("Expected type=%v for %q, got %v", typ, name, got)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package graphite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/heroku/agentmon"
+)
+
+// parseLine parses a plaintext protocol line, `path value [timestamp]`,
+// into m. The path may carry tags, as in `path;key=value;key2=value2`.
+// Without a timestamp, or with a timestamp of -1, the measurement is
+// taken at now.
+func parseLine(line []byte, mappings []Mapping, now time.Time, m *agentmon.Measurement) error {
+	fields := bytes.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return fmt.Errorf("expected `path value [timestamp]`, got %q", string(line))
+	}
+
+	name, tags, err := parsePath(fields[0])
+	if err != nil {
+		return err
+	}
+
+	value, err := strconv.ParseFloat(string(fields[1]), 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("invalid value %q", string(fields[1]))
+	}
+
+	ts := now
+	if len(fields) == 3 {
+		secs, err := strconv.ParseFloat(string(fields[2]), 64)
+		if err != nil || secs < -1 {
+			return fmt.Errorf("invalid timestamp %q", string(fields[2]))
+		}
+		if secs != -1 {
+			whole, frac := math.Modf(secs)
+			ts = time.Unix(int64(whole), int64(frac*1e9))
+		}
+	}
+
+	*m = agentmon.Measurement{
+		Name:       name,
+		Timestamp:  ts,
+		Type:       typeOf(mappings, name),
+		Value:      value,
+		SampleRate: 1,
+		Tags:       tags,
+	}
+	return nil
+}
+
+// parsePath splits a path into its name, and the tags that follow it,
+// if any.
+func parsePath(path []byte) (string, agentmon.Tags, error) {
+	parts := bytes.Split(path, []byte(";"))
+	if len(parts[0]) == 0 {
+		return "", nil, errors.New("empty metric path")
+	}
+
+	var tags agentmon.Tags
+	for _, part := range parts[1:] {
+		i := bytes.IndexByte(part, '=')
+		if i <= 0 || i == len(part)-1 {
+			return "", nil, fmt.Errorf("invalid tag %q", string(part))
+		}
+		tags = append(tags, agentmon.Tag{Key: string(part[:i]), Value: string(part[i+1:])})
+	}
+	return string(parts[0]), tags, nil
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package graphite
+
+import (
+	"testing"
+	"time"
+
+	am "github.com/heroku/agentmon"
+)
+
+func TestParseLine(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	mappings := []Mapping{{Pattern: "*.requests", Type: am.Counter}}
+
+	for _, tc := range []struct {
+		input string
+		name  string
+		typ   am.MetricType
+		value float64
+		ts    time.Time
+		tags  am.Tags
+	}{
+		{"web.load 0.5 1400000000", "web.load", am.Gauge, 0.5, time.Unix(1400000000, 0), nil},
+		{"web.load 0.5", "web.load", am.Gauge, 0.5, now, nil},
+		{"web.load 0.5 -1", "web.load", am.Gauge, 0.5, now, nil},
+		{"web.load\t-2  1400000000.5", "web.load", am.Gauge, -2, time.Unix(1400000000, 5e8), nil},
+		{"web.requests 3 1400000000", "web.requests", am.Counter, 3, time.Unix(1400000000, 0), nil},
+		{"web.load;dyno=web.1;region=us 1 1400000000", "web.load", am.Gauge, 1, time.Unix(1400000000, 0),
+			am.Tags{{Key: "dyno", Value: "web.1"}, {Key: "region", Value: "us"}}},
+	} {
+		var m am.Measurement
+		if err := parseLine([]byte(tc.input), mappings, now, &m); err != nil {
+			t.Errorf("Unexpected error for %q: %s", tc.input, err)
+			continue
+		}
+
+		if m.Name != tc.name {
+			t.Errorf("Expected name=%q, got=%q", tc.name, m.Name)
+		}
+		if m.Type != tc.typ {
+			t.Errorf("Expected type=%v, got=%v for %q", tc.typ, m.Type, tc.input)
+		}
+		if m.Value != tc.value {
+			t.Errorf("Expected value=%v, got=%v for %q", tc.value, m.Value, tc.input)
+		}
+		if !m.Timestamp.Equal(tc.ts) {
+			t.Errorf("Expected timestamp=%v, got=%v for %q", tc.ts, m.Timestamp, tc.input)
+		}
+		if m.Series().Key() != (am.Series{Name: tc.name, Tags: tc.tags}).Key() {
+			t.Errorf("Expected tags=%v, got=%v for %q", tc.tags, m.Tags, tc.input)
+		}
+	}
+}
+
+func TestParseLineErrors(t *testing.T) {
+	for _, input := range []string{
+		"web.load",
+		"web.load 1 2 3",
+		"web.load abc",
+		"web.load NaN",
+		"web.load 1 yesterday",
+		"web.load 1 -5",
+		";dyno=web.1 1",
+		"web.load;dyno 1",
+		"web.load;=web.1 1",
+	} {
+		var m am.Measurement
+		if err := parseLine([]byte(input), nil, time.Now(), &m); err == nil {
+			t.Errorf("Expected an error for %q, got %+v", input, m)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agentmon
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHyperLogLogCount(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 100, 1000, 10000, 100000} {
+		h := NewHyperLogLog()
+		for i := 0; i < n; i++ {
+			h.Add(fmt.Sprintf("user%d", i))
+			// Duplicates shouldn't count.
+			h.Add(fmt.Sprintf("user%d", i))
+		}
+
+		got := float64(h.Count())
+		if n == 0 {
+			if got != 0 {
+				t.Errorf("n=%d: got %f, want 0", n, got)
+			}
+			continue
+		}
+		if !within(got, float64(n), 0.05) {
+			t.Errorf("n=%d: got %f, want within 5%%", n, got)
+		}
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	a, b := NewHyperLogLog(), NewHyperLogLog()
+	for i := 0; i < 1000; i++ {
+		a.Add(fmt.Sprintf("user%d", i))
+	}
+	for i := 500; i < 1500; i++ {
+		b.Add(fmt.Sprintf("user%d", i))
+	}
+
+	a.Merge(b)
+
+	if got := float64(a.Count()); !within(got, 1500, 0.05) {
+		t.Errorf("got %f, want ~1500", got)
+	}
+}
+
+func TestHyperLogLogSnapshot(t *testing.T) {
+	h := NewHyperLogLog()
+	h.Add("a")
+
+	snap := h.Snapshot()
+	h.Add("b")
+	h.Add("c")
+
+	if got := snap.Count(); got != 1 {
+		t.Errorf("snapshot should not reflect updates to the original: got %d, want 1", got)
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package influx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/heroku/agentmon"
+)
+
+const (
+	maxPacketSizeUDP   = 65535
+	defaultMaxBodySize = 32 << 20
+)
+
+// MalformedMetricName is the name of the counter of lines that failed to
+// parse.
+const MalformedMetricName = "agentmon.influx.malformed"
+
+var precisions = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"n":  time.Nanosecond,
+	"ns": time.Nanosecond,
+	"u":  time.Microsecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// Listener defines the parameters needed to accept InfluxDB line
+// protocol over UDP, and over HTTP, as InfluxDB's `/write` endpoint.
+type Listener struct {
+	// Addr is the address to be used for listening for UDP datagrams,
+	// and HTTP requests.
+	Addr string
+
+	// MaxBodySize is the largest HTTP request body accepted, after
+	// decompression. Defaults to 32MiB.
+	MaxBodySize int64
+
+	// Inbox is the channel to use to observe Batches of incoming
+	// measurements.
+	Inbox chan *agentmon.Batch
+
+	// Backpressure is what's done with measurements that don't fit in
+	// the Inbox. Defaults to agentmon.Block.
+	Backpressure agentmon.Backpressure
+
+	// Stats, if set, counts the measurements dropped due to
+	// Backpressure, and the lines that fail to parse.
+	Stats *agentmon.Stats
+
+	// Debug is used to turn on extended logging, useful for debugging
+	// purposes.
+	Debug bool
+}
+
+// ListenUDP reads datagrams of newline separated lines sent to Addr
+// until ctx is cancelled. Timestamps are in nanoseconds.
+func (s Listener) ListenUDP(ctx context.Context) {
+	log.Printf("Listening on %s (influx udp)...", s.Addr)
+	conn, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		log.Fatalf("influx: listenUDP: %s", err)
+	}
+
+	s.serveUDP(ctx, conn)
+}
+
+func (s Listener) serveUDP(ctx context.Context, conn net.PacketConn) {
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	sender := s.newSender()
+	malformed := s.Stats.Counter(MalformedMetricName)
+	buf := make([]byte, maxPacketSizeUDP)
+
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				if s.Debug {
+					log.Println("debug: stopping influx udp listener")
+				}
+				return
+			}
+			log.Printf("influx: read: %s", err)
+			continue
+		}
+
+		ok, _ := s.parseLines(ctx, buf[:n], time.Nanosecond, sender, malformed)
+		if !ok || !sender.Flush(ctx) {
+			return
+		}
+	}
+}
+
+// ListenHTTP serves InfluxDB's `/write`, and `/ping`, endpoints on Addr
+// until ctx is cancelled.
+func (s Listener) ListenHTTP(ctx context.Context) {
+	log.Printf("Listening on %s (influx http)...", s.Addr)
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		log.Fatalf("influx: listenHTTP: %s", err)
+	}
+
+	s.serveHTTP(ctx, listener)
+}
+
+func (s Listener) serveHTTP(ctx context.Context, listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/write", s.handleWrite)
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Requests are cancelled along with ctx, so that Shutdown doesn't
+	// wait on any blocked sending to the Inbox.
+	server := &http.Server{
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		log.Printf("influx: serve: %s", err)
+	}
+	if s.Debug {
+		log.Println("debug: stopping influx http listener")
+	}
+}
+
+// handleWrite handles a `/write` request, whose body is newline
+// separated lines, optionally gzipped. The `precision` query parameter
+// sets the unit of timestamps, which defaults to nanoseconds.
+func (s Listener) handleWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "expected POST")
+		return
+	}
+
+	precision, ok := precisions[r.URL.Query().Get("precision")]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid precision %q", r.URL.Query().Get("precision")))
+		return
+	}
+
+	maxBodySize := s.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = defaultMaxBodySize
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, maxBodySize+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if int64(len(data)) > maxBodySize {
+		writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+		return
+	}
+
+	ctx := r.Context()
+	sender := s.newSender()
+	ok, err = s.parseLines(ctx, data, precision, sender, s.Stats.Counter(MalformedMetricName))
+	if !ok || !sender.Flush(ctx) {
+		writeError(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+
+	// As with InfluxDB, the lines that parsed are kept, even if some
+	// didn't.
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "partial write: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// parseLines sends the measurements parsed from each of the newline
+// separated lines in data with sender. It returns false if ctx was
+// cancelled, along with the first error parsing a line, if any.
+func (s Listener) parseLines(ctx context.Context, data []byte, precision time.Duration, sender *agentmon.Sender, malformed *agentmon.StatCounter) (bool, error) {
+	var firstErr error
+	now := time.Now()
+
+	ok := true
+	add := func(m *agentmon.Measurement) {
+		ok = ok && sender.Add(ctx, m)
+	}
+
+	for len(data) > 0 && ok {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		if err := parseLine(line, precision, now, add); err != nil {
+			malformed.Add(1)
+			if s.Debug {
+				log.Printf("debug: influx: %s", err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return ok, firstErr
+}
+
+// newSender returns a Sender to the Inbox that applies Backpressure.
+func (s Listener) newSender() *agentmon.Sender {
+	return agentmon.NewSender(s.Inbox, s.Backpressure, s.Stats, "influx")
+}
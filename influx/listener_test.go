@@ -0,0 +1,177 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package influx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	am "github.com/heroku/agentmon"
+	"github.com/heroku/agentmon/internal/testutil"
+)
+
+func TestListenUDP(t *testing.T) {
+	batches, inbox := testutil.Inbox(t, 10)
+	listener := Listener{Inbox: batches}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		listener.serveUDP(ctx, conn)
+	}()
+	defer wg.Wait()
+	defer cancel()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer client.Close()
+
+	client.Write([]byte("# a comment\ncpu,host=a value=1\n\nmem used=2i,free=3i"))
+	testutil.ExpectValue(t, inbox, "cpu", 1)
+	testutil.ExpectValue(t, inbox, "mem.used", 2)
+	testutil.ExpectValue(t, inbox, "mem.free", 3)
+}
+
+func TestHandleWrite(t *testing.T) {
+	batches, inbox := testutil.Inbox(t, 10)
+	stats := am.NewStats()
+	listener := Listener{Inbox: batches, Stats: stats}
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte("disk used=4 1400000000\n"))
+	w.Close()
+
+	for _, tc := range []struct {
+		query    string
+		body     []byte
+		encoding string
+		code     int
+	}{
+		{"?precision=s", []byte("cpu value=1 1400000000\nmem used=2i 1400000000"), "", http.StatusNoContent},
+		{"?precision=s", gz.Bytes(), "gzip", http.StatusNoContent},
+		{"", []byte("load value=3\nload value=x"), "", http.StatusBadRequest},
+		{"?precision=fortnights", []byte("cpu value=1"), "", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/write"+tc.query, bytes.NewReader(tc.body))
+		if tc.encoding != "" {
+			req.Header.Set("Content-Encoding", tc.encoding)
+		}
+		rec := httptest.NewRecorder()
+		listener.handleWrite(rec, req)
+
+		if rec.Code != tc.code {
+			t.Errorf("Expected %d for %q, got %d: %s", tc.code, tc.body, rec.Code, rec.Body)
+		}
+	}
+
+	for _, exp := range []struct {
+		name  string
+		value float64
+	}{{"cpu", 1}, {"mem.used", 2}, {"disk.used", 4}, {"load", 3}} {
+		select {
+		case m := <-inbox:
+			if m.Name != exp.name || m.Value != exp.value {
+				t.Errorf("Expected %s=%v got %s=%v", exp.name, exp.value, m.Name, m.Value)
+			}
+			if exp.name != "load" && !m.Timestamp.Equal(time.Unix(1400000000, 0)) {
+				t.Errorf("Expected the supplied timestamp for %s, got %v", m.Name, m.Timestamp)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected a measurement for %s", exp.name)
+		}
+	}
+
+	if n := stats.Counter(MalformedMetricName).Value(); n != 1 {
+		t.Errorf("Expected 1 malformed line, got %d", n)
+	}
+}
+
+func TestListenHTTP(t *testing.T) {
+	batches, inbox := testutil.Inbox(t, 10)
+	listener := Listener{Inbox: batches}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+
+	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer close(done)
+		listener.serveHTTP(ctx, l)
+	}()
+
+	url := "http://" + l.Addr().String()
+	resp, err := http.Get(url + "/ping")
+	if err != nil {
+		t.Fatalf("ping: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected 204 from /ping, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(url+"/write?db=telegraf", "text/plain", strings.NewReader("cpu value=1"))
+	if err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected 204 from /write, got %d", resp.StatusCode)
+	}
+	testutil.ExpectValue(t, inbox, "cpu", 1)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected serveHTTP to return once cancelled")
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package influx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/heroku/agentmon"
+)
+
+// parseLine parses a line protocol line,
+// `measurement[,tag=value...] field=value[,field=value...] [timestamp]`,
+// calling fn with a gauge for each numeric, or boolean, field. A field
+// named `value` is named after the measurement, and any other is named
+// `measurement.field`. String fields are ignored. The timestamp, if
+// any, is in units of precision.
+func parseLine(line []byte, precision time.Duration, now time.Time, fn func(*agentmon.Measurement)) error {
+	key, rest := cut(line, ' ', false)
+	fieldSet, rest := cut(rest, ' ', true)
+	if len(key) == 0 || len(fieldSet) == 0 {
+		return fmt.Errorf("expected `measurement field=value`, got %q", string(line))
+	}
+
+	keyParts := split(key, ',', false)
+	name := unescape(keyParts[0])
+	if name == "" {
+		return fmt.Errorf("empty measurement in %q", string(line))
+	}
+
+	var tags agentmon.Tags
+	for _, part := range keyParts[1:] {
+		k, v, err := pair(part)
+		if err != nil {
+			return fmt.Errorf("invalid tag %q: %s", string(part), err)
+		}
+		tags = append(tags, agentmon.Tag{Key: unescape(k), Value: unescape(v)})
+	}
+
+	ts := now
+	if rest = bytes.TrimSpace(rest); len(rest) > 0 {
+		n, err := strconv.ParseInt(string(rest), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp %q", string(rest))
+		}
+		if p := int64(precision); n > math.MaxInt64/p || n < math.MinInt64/p {
+			return fmt.Errorf("timestamp %q out of range", string(rest))
+		}
+		ts = time.Unix(0, n*int64(precision))
+	}
+
+	fields := split(fieldSet, ',', true)
+	ms := make([]agentmon.Measurement, 0, len(fields))
+	for _, field := range fields {
+		k, v, err := pair(field)
+		if err != nil {
+			return fmt.Errorf("invalid field %q: %s", string(field), err)
+		}
+
+		value, ok, err := parseFieldValue(v)
+		if err != nil {
+			return fmt.Errorf("invalid field %q: %s", string(field), err)
+		}
+		if !ok {
+			continue
+		}
+
+		fieldName := name
+		if k := unescape(k); k != "value" {
+			fieldName = name + "." + k
+		}
+		ms = append(ms, agentmon.Measurement{
+			Name:       fieldName,
+			Timestamp:  ts,
+			Type:       agentmon.Gauge,
+			Value:      value,
+			SampleRate: 1,
+			Tags:       tags,
+		})
+	}
+
+	// Fields are only passed on once they've all parsed, so that a line
+	// with a bad field is rejected as a whole.
+	for i := range ms {
+		fn(&ms[i])
+	}
+	return nil
+}
+
+// parseFieldValue parses a float, integer (`1i`), unsigned (`1u`), or
+// boolean field value. String values are valid, but not returned.
+func parseFieldValue(v []byte) (float64, bool, error) {
+	if len(v) == 0 {
+		return 0, false, errors.New("empty value")
+	}
+
+	switch string(v) {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+
+	switch v[0] {
+	case '"':
+		if len(v) < 2 || v[len(v)-1] != '"' {
+			return 0, false, errors.New("unterminated string")
+		}
+		return 0, false, nil
+	}
+
+	switch v[len(v)-1] {
+	case 'i':
+		n, err := strconv.ParseInt(string(v[:len(v)-1]), 10, 64)
+		return float64(n), err == nil, err
+	case 'u':
+		n, err := strconv.ParseUint(string(v[:len(v)-1]), 10, 64)
+		return float64(n), err == nil, err
+	}
+
+	f, err := strconv.ParseFloat(string(v), 64)
+	if err == nil && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		err = errors.New("not a finite number")
+	}
+	return f, err == nil, err
+}
+
+// pair splits b at its first unescaped '='.
+func pair(b []byte) ([]byte, []byte, error) {
+	k, v := cut(b, '=', false)
+	if len(k) == 0 || len(v) == 0 || len(k) == len(b) {
+		return nil, nil, errors.New("expected key=value")
+	}
+	return k, v, nil
+}
+
+// cut splits b around the first sep that isn't escaped by a backslash,
+// or, if quoted is true, within a double quoted string.
+func cut(b []byte, sep byte, quoted bool) ([]byte, []byte) {
+	inQuotes := false
+	for i := 0; i < len(b); i++ {
+		switch c := b[i]; {
+		case c == '\\':
+			i++
+		case quoted && c == '"':
+			inQuotes = !inQuotes
+		case c == sep && !inQuotes:
+			return b[:i], b[i+1:]
+		}
+	}
+	return b, nil
+}
+
+// split splits b around every sep that cut would.
+func split(b []byte, sep byte, quoted bool) [][]byte {
+	var out [][]byte
+	for {
+		part, rest := cut(b, sep, quoted)
+		out = append(out, part)
+		if rest == nil {
+			return out
+		}
+		b = rest
+	}
+}
+
+// unescape removes the backslashes escaping commas, equals signs, and
+// spaces in b.
+func unescape(b []byte) string {
+	if bytes.IndexByte(b, '\\') < 0 {
+		return string(b)
+	}
+
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] == '\\' && i+1 < len(b) {
+			switch b[i+1] {
+			case ',', '=', ' ':
+				i++
+			}
+		}
+		out = append(out, b[i])
+	}
+	return string(out)
+}
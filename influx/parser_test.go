@@ -0,0 +1,143 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package influx
+
+import (
+	"testing"
+	"time"
+
+	am "github.com/heroku/agentmon"
+)
+
+func parseAll(line string, precision time.Duration, now time.Time) ([]am.Measurement, error) {
+	var out []am.Measurement
+	err := parseLine([]byte(line), precision, now, func(m *am.Measurement) {
+		out = append(out, *m)
+	})
+	return out, err
+}
+
+func TestParseLine(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+
+	for _, tc := range []struct {
+		input     string
+		precision time.Duration
+		expected  []am.Measurement
+	}{
+		{
+			input: "cpu value=0.5",
+			expected: []am.Measurement{
+				{Name: "cpu", Value: 0.5, Timestamp: now},
+			},
+		},
+		{
+			input: "cpu,host=a,region=us user=1i,system=2.5,idle=3u,up=t,label=\"x y, z\" 1400000000000000000",
+			expected: []am.Measurement{
+				{Name: "cpu.user", Value: 1, Timestamp: time.Unix(1400000000, 0), Tags: am.Tags{{Key: "host", Value: "a"}, {Key: "region", Value: "us"}}},
+				{Name: "cpu.system", Value: 2.5, Timestamp: time.Unix(1400000000, 0), Tags: am.Tags{{Key: "host", Value: "a"}, {Key: "region", Value: "us"}}},
+				{Name: "cpu.idle", Value: 3, Timestamp: time.Unix(1400000000, 0), Tags: am.Tags{{Key: "host", Value: "a"}, {Key: "region", Value: "us"}}},
+				{Name: "cpu.up", Value: 1, Timestamp: time.Unix(1400000000, 0), Tags: am.Tags{{Key: "host", Value: "a"}, {Key: "region", Value: "us"}}},
+			},
+		},
+		{
+			input:     "disk\\ io,path=/var\\,log read=-2 1400000000",
+			precision: time.Second,
+			expected: []am.Measurement{
+				{Name: "disk io.read", Value: -2, Timestamp: time.Unix(1400000000, 0), Tags: am.Tags{{Key: "path", Value: "/var,log"}}},
+			},
+		},
+		{
+			input:    "events message=\"only a string\"",
+			expected: nil,
+		},
+	} {
+		precision := tc.precision
+		if precision == 0 {
+			precision = time.Nanosecond
+		}
+
+		ms, err := parseAll(tc.input, precision, now)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %s", tc.input, err)
+			continue
+		}
+		if len(ms) != len(tc.expected) {
+			t.Errorf("Expected %d measurements for %q, got %+v", len(tc.expected), tc.input, ms)
+			continue
+		}
+
+		for i, exp := range tc.expected {
+			m := ms[i]
+			if m.Series().Key() != exp.Series().Key() {
+				t.Errorf("Expected series %+v, got %+v", exp.Series(), m.Series())
+			}
+			if m.Value != exp.Value || m.Type != am.Gauge {
+				t.Errorf("Expected the gauge %s=%v, got %+v", exp.Name, exp.Value, m)
+			}
+			if !m.Timestamp.Equal(exp.Timestamp) {
+				t.Errorf("Expected timestamp=%v for %s, got %v", exp.Timestamp, exp.Name, m.Timestamp)
+			}
+		}
+	}
+}
+
+func TestParseLineErrors(t *testing.T) {
+	for _, input := range []string{
+		"cpu",
+		"cpu ",
+		",host=a value=1",
+		"cpu,host value=1",
+		"cpu,host=a value",
+		"cpu value=abc",
+		"cpu value=1x",
+		"cpu value=NaN",
+		"cpu value=\"unterminated",
+		"cpu value=1 yesterday",
+		"cpu good=1,bad=x",
+	} {
+		if ms, err := parseAll(input, time.Nanosecond, time.Now()); err == nil || len(ms) > 0 {
+			t.Errorf("Expected only an error for %q, got %+v", input, ms)
+		}
+	}
+
+	// Timestamps that overflow once converted to nanoseconds.
+	for input, precision := range map[string]time.Duration{
+		"cpu value=1 10000000000":    time.Second,
+		"cpu value=1 -10000000000":   time.Second,
+		"cpu value=1 10000000000000": time.Millisecond,
+		"cpu value=1 3000000":        time.Hour,
+	} {
+		if ms, err := parseAll(input, precision, time.Now()); err == nil || len(ms) > 0 {
+			t.Errorf("Expected only an error for %q at %v, got %+v", input, precision, ms)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package testutil holds helpers for testing agentmon's sources.
+package testutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heroku/agentmon"
+)
+
+// Inbox returns an Inbox of the given size for a source under test, and
+// a channel of the measurements sent to it, one at a time. Batches are
+// released once read, and reading stops when t's test finishes.
+func Inbox(t testing.TB, size int) (chan *agentmon.Batch, chan *agentmon.Measurement) {
+	batches := make(chan *agentmon.Batch, size)
+	ms := make(chan *agentmon.Measurement, size)
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+
+	go func() {
+		for {
+			select {
+			case b := <-batches:
+				for i := range b.Measurements {
+					m := b.Measurements[i]
+					select {
+					case ms <- &m:
+					case <-stop:
+						return
+					}
+				}
+				b.Release()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return batches, ms
+}
+
+// ExpectMeasurement fails t unless the next measurement from inbox,
+// within a second, is named name. It returns the measurement.
+func ExpectMeasurement(t testing.TB, inbox <-chan *agentmon.Measurement, name string) *agentmon.Measurement {
+	t.Helper()
+	select {
+	case m := <-inbox:
+		if m.Name != name {
+			t.Errorf("Expected name=%q got=%q", name, m.Name)
+		}
+		return m
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a measurement for %s", name)
+		return nil
+	}
+}
+
+// ExpectValue is as ExpectMeasurement, but also fails t unless the
+// measurement's Value is value.
+func ExpectValue(t testing.TB, inbox <-chan *agentmon.Measurement, name string, value float64) {
+	t.Helper()
+	if m := ExpectMeasurement(t, inbox, name); m.Value != value {
+		t.Errorf("Expected %s=%v got %v", name, value, m.Value)
+	}
+}
@@ -46,8 +46,23 @@ const (
 	// Gauge represents the value right now.
 	Gauge
 
-	// Timer is currently unused, but exists for statsd parsing purposes.
+	// Timer represents a duration, which is summarized for a flush
+	// interval as a count, sum, minimum, maximum, and sum of squares.
 	Timer
+
+	// Set represents the number of distinct members observed during a
+	// flush interval.
+	Set
+
+	// Histogram represents a value, such as a latency, or a payload
+	// size, whose distribution is summarized for a flush interval as a
+	// count, sum, and quantiles.
+	Histogram
+
+	// Distribution is summarized as a Histogram is. DogStatsD clients
+	// send them for distributions meant to be aggregated globally,
+	// which agentmon, with only a dyno's view, can't do.
+	Distribution
 )
 
 // Measurement is a point in time value that is used to amend a metric.
@@ -69,6 +84,13 @@ type Measurement struct {
 	// For most applications, this should be set to 1.0
 	SampleRate float32
 
+	// Member is the value added to a Set. It is unused by other types.
+	Member string
+
+	// Tags further identify the metric to contribute to. Measurements
+	// with the same Name, but different Tags, amend different metrics.
+	Tags Tags
+
 	// Modifier allows gauges to be treated differently
 	//
 	// A value of "-" subtracts Value from the metric's previous value.
@@ -77,13 +99,90 @@ type Measurement struct {
 	Modifier string
 }
 
+// Series returns the Series the Measurement contributes to.
+func (m *Measurement) Series() Series {
+	return Series{Name: m.Name, Tags: m.Tags}
+}
+
 // MetricSet provides a container for a set of metrics, and encodes
 // the rules for how metrics are updated given a Measurement.
+//
+// Metrics are keyed by Series.Key, which for untagged metrics is simply
+// the metric name. Use Series to recover the name and tags of a key.
+// Distributions summarize both Histograms and Distributions.
 type MetricSet struct {
-	Counters     map[string]float64 `json:"counters,omitempty"`
-	Gauges       map[string]float64 `json:"gauges,omitempty"`
-	monoCounters map[string]float64
-	parent       *MetricSet
+	Counters      map[string]float64      `json:"counters,omitempty"`
+	Gauges        map[string]float64      `json:"gauges,omitempty"`
+	Timers        map[string]*Summary     `json:"timers,omitempty"`
+	Sets          map[string]*HyperLogLog `json:"-"`
+	Distributions map[string]*Summary     `json:"distributions,omitempty"`
+	monoCounters  map[string]float64
+	series        map[string]Series
+	parent        *MetricSet
+}
+
+// Summary accumulates the values observed for a Timer during a flush
+// interval. Count, Sum, and SumSquares are scaled by the inverse of
+// each Measurement's SampleRate; Min and Max are not.
+type Summary struct {
+	Count      float64 `json:"count"`
+	Sum        float64 `json:"sum"`
+	Min        float64 `json:"min"`
+	Max        float64 `json:"max"`
+	SumSquares float64 `json:"sumsq"`
+
+	// Sketch tracks the distribution of observed values, so that
+	// quantiles can be estimated.
+	Sketch *Sketch `json:"-"`
+}
+
+// NewSummary constructs an empty Summary.
+func NewSummary() *Summary {
+	return &Summary{Sketch: NewSketch()}
+}
+
+// Observe records value, taken at the given sample rate, in the Summary.
+func (s *Summary) Observe(value float64, sampleRate float32) {
+	weight := 1 / float64(sampleRate)
+	if s.Count == 0 || value < s.Min {
+		s.Min = value
+	}
+	if s.Count == 0 || value > s.Max {
+		s.Max = value
+	}
+	s.Count += weight
+	s.Sum += value * weight
+	s.SumSquares += value * value * weight
+	s.Sketch.Add(value, weight)
+}
+
+// Quantile returns an estimate of the observed value at quantile q.
+func (s *Summary) Quantile(q float64) float64 {
+	return s.Sketch.Quantile(q)
+}
+
+// Merge adds the values observed by other to the Summary.
+func (s *Summary) Merge(other *Summary) {
+	if other.Count == 0 {
+		return
+	}
+	if s.Count == 0 || other.Min < s.Min {
+		s.Min = other.Min
+	}
+	if s.Count == 0 || other.Max > s.Max {
+		s.Max = other.Max
+	}
+	s.Count += other.Count
+	s.Sum += other.Sum
+	s.SumSquares += other.SumSquares
+	s.Sketch.Merge(other.Sketch)
+}
+
+// Snapshot returns a copy of the Summary.
+func (s *Summary) Snapshot() *Summary {
+	out := NewSummary()
+	out.Merge(s)
+	return out
 }
 
 // NewMetricSet constructs a MetricSet which can be used to turn
@@ -94,10 +193,14 @@ type MetricSet struct {
 // DerivedCounters, and modified Guages.
 func NewMetricSet(parent *MetricSet) *MetricSet {
 	return &MetricSet{
-		Counters:     make(map[string]float64),
-		Gauges:       make(map[string]float64),
-		monoCounters: make(map[string]float64),
-		parent:       parent,
+		Counters:      make(map[string]float64),
+		Gauges:        make(map[string]float64),
+		Timers:        make(map[string]*Summary),
+		Sets:          make(map[string]*HyperLogLog),
+		Distributions: make(map[string]*Summary),
+		monoCounters:  make(map[string]float64),
+		series:        make(map[string]Series),
+		parent:        parent,
 	}
 }
 
@@ -107,43 +210,77 @@ func NewMetricSet(parent *MetricSet) *MetricSet {
 // In cases where a Measurement for a Metric has a different Type than
 // was previously updated, a new Metric with that type will be created.
 func (ms *MetricSet) Update(m *Measurement) {
+	key := m.Name
+	if len(m.Tags) > 0 {
+		series := m.Series()
+		key = series.Key()
+		if _, ok := ms.series[key]; !ok {
+			series.Tags = series.Tags.Sorted()
+			ms.series[key] = series
+		}
+	}
+
 	switch m.Type {
 	case Counter:
-		ms.Counters[m.Name] += m.Value / float64(m.SampleRate)
+		ms.Counters[key] += m.Value / float64(m.SampleRate)
 
 	case DerivedCounter:
 		current := m.Value
 		prev := 0.0
 
-		ms.monoCounters[m.Name] = current
+		ms.monoCounters[key] = current
 
 		if ms.parent != nil {
-			prev = ms.parent.monoCounters[m.Name]
+			prev = ms.parent.monoCounters[key]
 		}
 
 		val := current / float64(m.SampleRate)
 		if current < prev { // A reset has occurred
-			ms.Counters[m.Name] += val
+			ms.Counters[key] += val
 		} else {
-			ms.Counters[m.Name] += val - prev
+			ms.Counters[key] += val - prev
 		}
 
 	case Gauge:
 		prev := 0.0
 		if ms.parent != nil {
-			prev = ms.parent.Gauges[m.Name]
+			prev = ms.parent.Gauges[key]
 		}
 
 		val := (m.Value / float64(m.SampleRate))
 
 		switch m.Modifier {
 		case "+":
-			ms.Gauges[m.Name] = prev + val
+			ms.Gauges[key] = prev + val
 		case "-":
-			ms.Gauges[m.Name] = prev - val
+			ms.Gauges[key] = prev - val
 		default:
-			ms.Gauges[m.Name] = val
+			ms.Gauges[key] = val
 		}
+
+	case Timer:
+		summary, ok := ms.Timers[key]
+		if !ok {
+			summary = NewSummary()
+			ms.Timers[key] = summary
+		}
+		summary.Observe(m.Value, m.SampleRate)
+
+	case Histogram, Distribution:
+		summary, ok := ms.Distributions[key]
+		if !ok {
+			summary = NewSummary()
+			ms.Distributions[key] = summary
+		}
+		summary.Observe(m.Value, m.SampleRate)
+
+	case Set:
+		set, ok := ms.Sets[key]
+		if !ok {
+			set = NewHyperLogLog()
+			ms.Sets[key] = set
+		}
+		set.Add(m.Member)
 	}
 }
 
@@ -151,9 +288,13 @@ func (ms *MetricSet) Update(m *Measurement) {
 // the MetricSet's parent.
 func (ms *MetricSet) Snapshot() *MetricSet {
 	out := &MetricSet{
-		Counters:     make(map[string]float64),
-		Gauges:       make(map[string]float64),
-		monoCounters: make(map[string]float64),
+		Counters:      make(map[string]float64),
+		Gauges:        make(map[string]float64),
+		Timers:        make(map[string]*Summary),
+		Sets:          make(map[string]*HyperLogLog),
+		Distributions: make(map[string]*Summary),
+		monoCounters:  make(map[string]float64),
+		series:        make(map[string]Series),
 	}
 	for k, v := range ms.Counters {
 		out.Counters[k] = v
@@ -161,14 +302,34 @@ func (ms *MetricSet) Snapshot() *MetricSet {
 	for k, v := range ms.Gauges {
 		out.Gauges[k] = v
 	}
+	for k, v := range ms.Timers {
+		out.Timers[k] = v.Snapshot()
+	}
+	for k, v := range ms.Sets {
+		out.Sets[k] = v.Snapshot()
+	}
+	for k, v := range ms.Distributions {
+		out.Distributions[k] = v.Snapshot()
+	}
 	for k, v := range ms.monoCounters {
 		out.monoCounters[k] = v
 	}
+	for k, v := range ms.series {
+		out.series[k] = v
+	}
 
 	return out
 }
 
+// Series returns the name and tags of the metric keyed by key.
+func (ms *MetricSet) Series(key string) Series {
+	if s, ok := ms.series[key]; ok {
+		return s
+	}
+	return Series{Name: key}
+}
+
 // Len returns the cardinality of this set.
 func (ms *MetricSet) Len() int {
-	return len(ms.Counters) + len(ms.Gauges)
+	return len(ms.Counters) + len(ms.Gauges) + len(ms.Timers) + len(ms.Sets) + len(ms.Distributions)
 }
@@ -289,3 +289,218 @@ func TestMetricSetSnapshot(t *testing.T) {
 	}
 
 }
+
+func TestTimers(t *testing.T) {
+	underTest := NewMetricSet(nil)
+	for _, v := range []float64{10, 20, 30} {
+		underTest.Update(&Measurement{
+			Name:       "foo.bar",
+			Timestamp:  time.Now(),
+			Type:       Timer,
+			Value:      v,
+			SampleRate: 1.0,
+		})
+	}
+	underTest.Update(&Measurement{
+		Name:       "foo.bar",
+		Timestamp:  time.Now(),
+		Type:       Timer,
+		Value:      5,
+		SampleRate: 0.5,
+	})
+
+	got := underTest.Timers["foo.bar"]
+	if got == nil {
+		t.Fatalf("got nil, want a summary for foo.bar")
+	}
+
+	want := Summary{
+		Count:      5,
+		Sum:        70,
+		Min:        5,
+		Max:        30,
+		SumSquares: 1450,
+	}
+	stats := *got
+	stats.Sketch = nil
+	if stats != want {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+
+	if q := got.Quantile(0.5); q < 9.9 || q > 10.1 {
+		t.Errorf("got p50 %f, want ~10", q)
+	}
+
+	if underTest.Len() != 1 {
+		t.Errorf("got len %d, want 1", underTest.Len())
+	}
+
+	next := NewMetricSet(underTest.Snapshot())
+	if _, ok := next.Timers["foo.bar"]; ok {
+		t.Errorf("timers should not carry over to the next interval")
+	}
+}
+
+func TestDistributions(t *testing.T) {
+	underTest := NewMetricSet(nil)
+	for _, m := range []*Measurement{
+		{Name: "payload", Type: Histogram, Value: 100, SampleRate: 1},
+		{Name: "payload", Type: Distribution, Value: 300, SampleRate: 1},
+		{Name: "payload", Type: Histogram, Value: 200, SampleRate: 0.5},
+	} {
+		underTest.Update(m)
+	}
+
+	got := underTest.Distributions["payload"]
+	if got == nil {
+		t.Fatalf("got nil, want a summary for payload")
+	}
+	if got.Count != 4 || got.Sum != 800 {
+		t.Errorf("got count=%f sum=%f, want count=4 sum=800", got.Count, got.Sum)
+	}
+	if q := got.Quantile(0.5); q < 198 || q > 202 {
+		t.Errorf("got p50 %f, want ~200", q)
+	}
+	if len(underTest.Timers) != 0 || underTest.Len() != 1 {
+		t.Errorf("got %d timers, and len %d, want only a distribution", len(underTest.Timers), underTest.Len())
+	}
+
+	snap := underTest.Snapshot()
+	if snap.Distributions["payload"].Count != 4 {
+		t.Errorf("got a snapshot of %+v, want count=4", snap.Distributions["payload"])
+	}
+	if next := NewMetricSet(snap); len(next.Distributions) != 0 {
+		t.Errorf("distributions should not carry over to the next interval")
+	}
+}
+
+func TestSets(t *testing.T) {
+	underTest := NewMetricSet(nil)
+	for _, member := range []string{"user1", "user2", "user1", "user3"} {
+		underTest.Update(&Measurement{
+			Name:       "users.active",
+			Timestamp:  time.Now(),
+			Type:       Set,
+			Member:     member,
+			SampleRate: 1.0,
+		})
+	}
+
+	got := underTest.Sets["users.active"]
+	if got == nil {
+		t.Fatalf("got nil, want a set for users.active")
+	}
+	if got.Count() != 3 {
+		t.Errorf("got %d, want 3", got.Count())
+	}
+
+	snap := underTest.Snapshot()
+	if snap.Sets["users.active"].Count() != 3 {
+		t.Errorf("snapshot lost set members: got %d, want 3", snap.Sets["users.active"].Count())
+	}
+
+	next := NewMetricSet(snap)
+	if _, ok := next.Sets["users.active"]; ok {
+		t.Errorf("sets should not carry over to the next interval")
+	}
+}
+
+func TestTaggedSeries(t *testing.T) {
+	underTest := NewMetricSet(nil)
+	for _, tags := range []Tags{
+		{{"code", "200"}, {"type", "http"}},
+		{{"type", "http"}, {"code", "200"}},
+		{{"code", "500"}, {"type", "http"}},
+		nil,
+	} {
+		underTest.Update(&Measurement{
+			Name:       "requests",
+			Timestamp:  time.Now(),
+			Type:       Counter,
+			Value:      1.0,
+			SampleRate: 1.0,
+			Tags:       tags,
+		})
+	}
+
+	if underTest.Len() != 3 {
+		t.Errorf("got len %d, want 3", underTest.Len())
+	}
+
+	key := Series{Name: "requests", Tags: Tags{{"code", "200"}, {"type", "http"}}}.Key()
+	if got := underTest.Counters[key]; got != 2 {
+		t.Errorf("got %f, want 2", got)
+	}
+	if got := underTest.Counters["requests"]; got != 1 {
+		t.Errorf("got %f, want 1", got)
+	}
+
+	series := underTest.Snapshot().Series(key)
+	if series.Name != "requests" || len(series.Tags) != 2 || series.Tags[0].Key != "code" {
+		t.Errorf("got %+v, want requests tagged with code and type", series)
+	}
+}
+
+// benchmarkNames are the metrics the pipeline benchmarks cycle through.
+var benchmarkNames = []string{"web.requests", "web.errors", "db.queries", "db.errors"}
+
+// BenchmarkPipelineMeasurements sends each Measurement to a MetricSet
+// through a channel on its own, as sources once did.
+func BenchmarkPipelineMeasurements(b *testing.B) {
+	ch := make(chan *Measurement, 1000)
+	set := NewMetricSet(nil)
+	done := make(chan struct{})
+	go func() {
+		for m := range ch {
+			set.Update(m)
+		}
+		close(done)
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ch <- &Measurement{
+			Name:       benchmarkNames[i%len(benchmarkNames)],
+			Type:       Counter,
+			Value:      1,
+			SampleRate: 1,
+		}
+	}
+	close(ch)
+	<-done
+}
+
+// BenchmarkPipelineBatches sends Measurements to a MetricSet in pooled
+// Batches.
+func BenchmarkPipelineBatches(b *testing.B) {
+	ch := make(chan *Batch, 1000/BatchSize)
+	set := NewMetricSet(nil)
+	done := make(chan struct{})
+	go func() {
+		for batch := range ch {
+			set.UpdateBatch(batch)
+			batch.Release()
+		}
+		close(done)
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	batch := NewBatch()
+	for i := 0; i < b.N; i++ {
+		batch.Add(&Measurement{
+			Name:       benchmarkNames[i%len(benchmarkNames)],
+			Type:       Counter,
+			Value:      1,
+			SampleRate: 1,
+		})
+		if batch.Full() {
+			ch <- batch
+			batch = NewBatch()
+		}
+	}
+	ch <- batch
+	close(ch)
+	<-done
+}
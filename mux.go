@@ -0,0 +1,147 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agentmon
+
+import (
+	"context"
+	"reflect"
+)
+
+// QueueDepthMetricName is the Stats gauge of how many Batches are
+// waiting in a Mux's queue. It's tagged with the `source`.
+const QueueDepthMetricName = "agentmon.queue.depth"
+
+// Mux merges the Batches of several sources into one channel, giving
+// each source a queue of its own, so that a flood from one can't crowd
+// out the others. Queues are served in deficit round robin: each
+// round, a queue may pass on its weight in BatchSize worth of
+// Measurements, with whatever it overdraws taken from its next turn.
+type Mux struct {
+	out    chan *Batch
+	stats  *Stats
+	queues []*muxQueue
+}
+
+type muxQueue struct {
+	source  string
+	weight  int
+	deficit int
+	ch      chan *Batch
+}
+
+// NewMux constructs a Mux that sends to out. Queue depths are reported
+// to stats, which may be nil.
+func NewMux(out chan *Batch, stats *Stats) *Mux {
+	return &Mux{out: out, stats: stats}
+}
+
+// Source adds a queue of size Batches for the named source, and returns
+// it, to be used as the source's Inbox. A weight below 1 is treated as
+// 1. Sources must be added before calling Run.
+func (mx *Mux) Source(source string, size, weight int) chan *Batch {
+	if weight < 1 {
+		weight = 1
+	}
+
+	q := &muxQueue{source: source, weight: weight, ch: make(chan *Batch, size)}
+	mx.queues = append(mx.queues, q)
+	mx.stats.GaugeFunc(QueueDepthMetricName, func() float64 {
+		return float64(len(q.ch))
+	}, Tag{Key: "source", Value: source})
+	return q.ch
+}
+
+// Run moves Batches from the sources' queues to the output channel
+// until ctx is done. Whatever is queued at that point is then sent
+// along before Run returns, so sources should be stopped first.
+func (mx *Mux) Run(ctx context.Context) {
+	// idle waits on every queue, and ctx, at once.
+	idle := make([]reflect.SelectCase, len(mx.queues)+1)
+	idle[0] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}
+	for i, q := range mx.queues {
+		idle[i+1] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(q.ch)}
+	}
+
+	for {
+		if ctx.Err() != nil {
+			mx.drain()
+			return
+		}
+
+		if mx.round() > 0 {
+			continue
+		}
+
+		// Everything is empty, so wait for something to do.
+		if chosen, v, _ := reflect.Select(idle); chosen > 0 {
+			mx.out <- v.Interface().(*Batch)
+		}
+	}
+}
+
+// round gives each queue its turn, returning how many Batches were
+// sent.
+func (mx *Mux) round() int {
+	sent := 0
+	for _, q := range mx.queues {
+		q.deficit += q.weight * BatchSize
+
+	queue:
+		for q.deficit > 0 {
+			select {
+			case b := <-q.ch:
+				q.deficit -= b.Len()
+				mx.out <- b
+				sent++
+			default:
+				// An idle queue can't save up for later.
+				q.deficit = 0
+				break queue
+			}
+		}
+	}
+	return sent
+}
+
+// drain sends along everything still queued.
+func (mx *Mux) drain() {
+	for _, q := range mx.queues {
+		for {
+			select {
+			case b := <-q.ch:
+				mx.out <- b
+				continue
+			default:
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agentmon
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fill queues n Batches on ch, each of size counters named name.
+func fill(ch chan *Batch, name string, n, size int) {
+	for i := 0; i < n; i++ {
+		b := NewBatch()
+		for j := 0; j < size; j++ {
+			b.Add(counter(name, 1))
+		}
+		ch <- b
+	}
+}
+
+// take reads n Batches from ch, counting them by name.
+func take(t *testing.T, ch chan *Batch, n int) map[string]int {
+	t.Helper()
+	out := make(map[string]int)
+	for i := 0; i < n; i++ {
+		select {
+		case b := <-ch:
+			out[b.Measurements[0].Name]++
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %d batches, got %d", n, i)
+		}
+	}
+	return out
+}
+
+func TestMuxFairness(t *testing.T) {
+	out := make(chan *Batch)
+	mux := NewMux(out, nil)
+	statsd := mux.Source("statsd", 100, 1)
+	prom := mux.Source("prom", 100, 1)
+
+	// statsd floods its queue with full batches, but prom still gets
+	// its turn, in which its small batches all fit.
+	fill(statsd, "statsd", 100, BatchSize)
+	fill(prom, "prom", 3, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go mux.Run(ctx)
+
+	got := take(t, out, 6)
+	if got["prom"] != 3 || got["statsd"] != 3 {
+		t.Errorf("Expected 3 of each, got %v", got)
+	}
+}
+
+func TestMuxWeights(t *testing.T) {
+	out := make(chan *Batch)
+	mux := NewMux(out, nil)
+	statsd := mux.Source("statsd", 100, 3)
+	prom := mux.Source("prom", 100, 1)
+
+	fill(statsd, "statsd", 100, BatchSize)
+	fill(prom, "prom", 100, BatchSize)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go mux.Run(ctx)
+
+	got := take(t, out, 8)
+	if got["prom"] != 2 || got["statsd"] != 6 {
+		t.Errorf("Expected 6 statsd, and 2 prom, got %v", got)
+	}
+}
+
+func TestMuxIdle(t *testing.T) {
+	out := make(chan *Batch)
+	mux := NewMux(out, nil)
+	prom := mux.Source("prom", 1, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go mux.Run(ctx)
+
+	// Sent while Run is waiting on the empty queues.
+	time.Sleep(time.Millisecond)
+	fill(prom, "prom", 1, 1)
+	if got := take(t, out, 1); got["prom"] != 1 {
+		t.Errorf("Expected prom, got %v", got)
+	}
+}
+
+func TestMuxDrain(t *testing.T) {
+	out := make(chan *Batch, 10)
+	mux := NewMux(out, nil)
+	statsd := mux.Source("statsd", 5, 1)
+	prom := mux.Source("prom", 5, 1)
+	fill(statsd, "statsd", 5, 1)
+	fill(prom, "prom", 5, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	mux.Run(ctx)
+
+	if len(out) != 10 {
+		t.Errorf("Expected everything queued to be sent, got %d", len(out))
+	}
+}
+
+func TestMuxQueueDepth(t *testing.T) {
+	stats := NewStats()
+	mux := NewMux(make(chan *Batch), stats)
+	fill(mux.Source("statsd", 5, 1), "statsd", 2, 1)
+
+	ms := stats.Collect()
+	if len(ms) != 1 {
+		t.Fatalf("Expected 1 measurement, got %d", len(ms))
+	}
+	m := ms[0]
+	if m.Name != QueueDepthMetricName || m.Type != Gauge || m.Value != 2 || m.Tags[0].Value != "statsd" {
+		t.Errorf("Unexpected queue depth %+v", m)
+	}
+}
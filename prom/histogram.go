@@ -0,0 +1,209 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package prom
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	ag "github.com/heroku/agentmon"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// histogramCounts are a histogram's cumulative bucket counts.
+type histogramCounts struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+	scrape uint64
+}
+
+// histogramToMeasurements converts m, of the histogram family name, to
+// _sum, _count, and per bucket _bucket derived counters, the latter
+// tagged with their upper bound as le, including +Inf. If any
+// histogramQuantiles are set, they're estimated as gauges, once a
+// previous scrape's counts are known.
+func (c *converter) histogramToMeasurements(name string, m *dto.Metric) []*ag.Measurement {
+	h := m.GetHistogram()
+	tags := tagsFor(m)
+	ts := msToTime(m.GetTimestampMs())
+
+	out := []*ag.Measurement{
+		{
+			Name:       name + "_sum",
+			Tags:       tags,
+			Timestamp:  ts,
+			Type:       ag.DerivedCounter,
+			Value:      h.GetSampleSum(),
+			SampleRate: 1.0,
+		},
+		{
+			Name:       name + "_count",
+			Tags:       tags,
+			Timestamp:  ts,
+			Type:       ag.DerivedCounter,
+			Value:      float64(h.GetSampleCount()),
+			SampleRate: 1.0,
+		},
+	}
+
+	// The text format includes the +Inf bucket, and the protobuf format
+	// leaves it implied by the count.
+	cur := &histogramCounts{count: h.GetSampleCount(), scrape: c.scrape}
+	for _, b := range h.GetBucket() {
+		cur.bounds = append(cur.bounds, b.GetUpperBound())
+		cur.counts = append(cur.counts, b.GetCumulativeCount())
+	}
+	if n := len(cur.bounds); n == 0 || !math.IsInf(cur.bounds[n-1], 1) {
+		cur.bounds = append(cur.bounds, math.Inf(1))
+		cur.counts = append(cur.counts, cur.count)
+	}
+
+	for i, bound := range cur.bounds {
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		out = append(out, &ag.Measurement{
+			Name:       name + "_bucket",
+			Tags:       append(tags[:len(tags):len(tags)], ag.Tag{Key: "le", Value: le}),
+			Timestamp:  ts,
+			Type:       ag.DerivedCounter,
+			Value:      float64(cur.counts[i]),
+			SampleRate: 1.0,
+		})
+	}
+
+	if len(c.histogramQuantiles) == 0 {
+		return out
+	}
+
+	key := ag.Series{Name: name, Tags: tags}.Key()
+	prev := c.histograms[key]
+	c.histograms[key] = cur
+	if prev == nil || !sameBounds(prev.bounds, cur.bounds) {
+		return out
+	}
+
+	bounds, counts, total := cur.since(prev)
+	if total == 0 {
+		return out
+	}
+	for _, q := range c.histogramQuantiles {
+		v := estimateQuantile(q, bounds, counts, total)
+		if math.IsNaN(v) {
+			continue
+		}
+		out = append(out, &ag.Measurement{
+			Name:       quantileName(name, q),
+			Tags:       tags,
+			Timestamp:  ts,
+			Type:       ag.Gauge,
+			Value:      v,
+			SampleRate: 1.0,
+		})
+	}
+	return out
+}
+
+// since returns h's bounds and cumulative counts, and the total count,
+// of the observations made since prev. If the histogram was reset in
+// between, that's everything h counts.
+func (h *histogramCounts) since(prev *histogramCounts) ([]float64, []float64, float64) {
+	reset := h.count < prev.count
+	for i := range h.counts {
+		reset = reset || h.counts[i] < prev.counts[i]
+	}
+
+	counts := make([]float64, len(h.counts))
+	for i, n := range h.counts {
+		if !reset {
+			n -= prev.counts[i]
+		}
+		counts[i] = float64(n)
+	}
+	if reset {
+		return h.bounds, counts, float64(h.count)
+	}
+	return h.bounds, counts, float64(h.count - prev.count)
+}
+
+func sameBounds(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// estimateQuantile estimates the q quantile of total observations, from
+// the cumulative counts of the buckets with upper bounds bounds. As with
+// Prometheus' histogram_quantile, values are assumed to be spread evenly
+// within a bucket, the lowest bucket is assumed to start at 0 (if its
+// bound is positive), and a quantile beyond the highest finite bound is
+// estimated as that bound.
+func estimateQuantile(q float64, bounds, counts []float64, total float64) float64 {
+	if len(bounds) == 0 {
+		return math.NaN()
+	}
+
+	rank := q * total
+	i := sort.Search(len(counts), func(i int) bool { return counts[i] >= rank })
+	if i == len(bounds) {
+		return bounds[i-1]
+	}
+	if math.IsInf(bounds[i], 1) {
+		if i == 0 {
+			return math.NaN()
+		}
+		return bounds[i-1]
+	}
+	if i == 0 && bounds[0] <= 0 {
+		return bounds[0]
+	}
+
+	lower, below := 0.0, 0.0
+	if i > 0 {
+		lower, below = bounds[i-1], counts[i-1]
+	}
+	if counts[i] == below {
+		return bounds[i]
+	}
+	return lower + (bounds[i]-lower)*(rank-below)/(counts[i]-below)
+}
+
+// quantileName names the gauge of the q quantile of name.
+func quantileName(name string, q float64) string {
+	return name + ".quantile_" + strconv.FormatFloat(q, 'f', -1, 64)
+}
@@ -34,10 +34,10 @@ import (
 	"context"
 	"io"
 	"log"
+	"math"
 	"mime"
 	"net/http"
 	"net/url"
-	"strings"
 	"time"
 
 	ag "github.com/heroku/agentmon"
@@ -68,8 +68,30 @@ type Poller struct {
 	// Prometheus endpoint.
 	AcceptHeader string
 
-	// Inbox is the channel to use to observe scraped measurements.
-	Inbox chan *ag.Measurement
+	// Inbox is the channel to use to observe Batches of scraped
+	// measurements.
+	Inbox chan *ag.Batch
+
+	// Backpressure is what's done with measurements that don't fit in
+	// the Inbox. Defaults to ag.Block, for at most one Interval.
+	Backpressure ag.Backpressure
+
+	// Stats, if set, counts the measurements dropped due to Backpressure.
+	Stats *ag.Stats
+
+	// HistogramQuantiles are the quantiles, between 0 and 1, estimated
+	// for each histogram, as gauges, from the observations bucketed
+	// since the previous scrape. None are, by default.
+	HistogramQuantiles []float64
+
+	// SummaryQuantiles are the quantiles, of those computed by each
+	// summary, that are reported as gauges. All are, if nil.
+	SummaryQuantiles []float64
+
+	// UntypedTypes overrides the type that untyped metric families are
+	// converted as, by family name. Otherwise, those ending in _total are
+	// derived counters, and the rest gauges.
+	UntypedTypes map[string]ag.MetricType
 
 	// Debug is used to turn on extended logging, useful for debugging
 	// purposes.
@@ -83,6 +105,7 @@ func (p Poller) Poll(ctx context.Context) {
 		p.Interval = defaultPollInterval
 	}
 
+	conv := p.newConverter()
 	t := time.NewTicker(p.Interval)
 
 	for {
@@ -96,28 +119,29 @@ func (p Poller) Poll(ctx context.Context) {
 			ch := make(chan *dto.MetricFamily, 1024)
 			tctx, cancel := context.WithTimeout(ctx, p.Interval)
 			go p.fetchFamilies(tctx, ch)
-			p.sync(tctx, ch)
+			p.sync(tctx, ch, conv)
 			cancel()
 		}
 	}
 }
 
-func (p Poller) sync(ctx context.Context, ch <-chan *dto.MetricFamily) {
+func (p Poller) sync(ctx context.Context, ch <-chan *dto.MetricFamily, conv *converter) {
+	sender := ag.NewSender(p.Inbox, p.Backpressure, p.Stats, "prom")
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case fam, ok := <-ch:
 			if !ok {
+				conv.endScrape()
+				sender.Flush(ctx)
 				return
 			}
 
-			if ms, ok := familyToMeasurements(fam); ok {
+			if ms, ok := conv.familyToMeasurements(fam); ok {
 				for _, m := range ms {
-					select {
-					case p.Inbox <- m:
-					default:
-						log.Printf("sync: metric set send would block: dropping")
+					if !sender.Add(ctx, m) {
+						return
 					}
 				}
 			}
@@ -256,13 +280,54 @@ func (p Poller) debugMF(msg string, mf *dto.MetricFamily) {
 	log.Println("--------------------------------------------")
 }
 
-func familyToMeasurements(mf *dto.MetricFamily) (out []*ag.Measurement, ok bool) {
+// converter turns scraped MetricFamilies into Measurements, remembering
+// what it needs to from one scrape to the next.
+type converter struct {
+	// histogramQuantiles are estimated for each histogram from the
+	// observations bucketed since the previous scrape.
+	histogramQuantiles []float64
+
+	// summaryQuantiles select the quantiles reported for summaries,
+	// unless nil.
+	summaryQuantiles []float64
+
+	// untypedTypes override the types inferred for untyped families.
+	untypedTypes map[string]ag.MetricType
+
+	// histograms are the bucket counts of each histogram series as of
+	// the scrape it was last seen in, by Series key.
+	histograms map[string]*histogramCounts
+	scrape     uint64
+}
+
+func (p Poller) newConverter() *converter {
+	return &converter{
+		histogramQuantiles: p.HistogramQuantiles,
+		summaryQuantiles:   p.SummaryQuantiles,
+		untypedTypes:       p.UntypedTypes,
+		histograms:         make(map[string]*histogramCounts),
+	}
+}
+
+// endScrape forgets the histograms that weren't in the scrape just
+// finished.
+func (c *converter) endScrape() {
+	for k, h := range c.histograms {
+		if h.scrape != c.scrape {
+			delete(c.histograms, k)
+		}
+	}
+	c.scrape++
+}
+
+func (c *converter) familyToMeasurements(mf *dto.MetricFamily) (out []*ag.Measurement, ok bool) {
 	name := mf.GetName()
 	switch mf.GetType() {
 	case dto.MetricType_GAUGE:
 		for _, m := range mf.Metric {
 			out = append(out, &ag.Measurement{
-				Name:       name + suffixFor(m),
+				Name:       name,
+				Tags:       tagsFor(m),
 				Timestamp:  msToTime(m.GetTimestampMs()),
 				Type:       ag.Gauge,
 				Value:      getValue(m),
@@ -273,7 +338,8 @@ func familyToMeasurements(mf *dto.MetricFamily) (out []*ag.Measurement, ok bool)
 	case dto.MetricType_COUNTER:
 		for _, m := range mf.Metric {
 			out = append(out, &ag.Measurement{
-				Name:       name + suffixFor(m),
+				Name:       name,
+				Tags:       tagsFor(m),
 				Timestamp:  msToTime(m.GetTimestampMs()),
 				Type:       ag.DerivedCounter,
 				Value:      getValue(m),
@@ -285,26 +351,81 @@ func familyToMeasurements(mf *dto.MetricFamily) (out []*ag.Measurement, ok bool)
 		for _, m := range mf.Metric {
 			summary := m.GetSummary()
 			out = append(out, &ag.Measurement{
-				Name:       name + "_sum" + suffixFor(m),
+				Name:       name + "_sum",
+				Tags:       tagsFor(m),
 				Timestamp:  msToTime(m.GetTimestampMs()),
 				Type:       ag.DerivedCounter,
 				Value:      summary.GetSampleSum(),
 				SampleRate: 1.0,
 			})
 			out = append(out, &ag.Measurement{
-				Name:       name + "_count" + suffixFor(m),
+				Name:       name + "_count",
+				Tags:       tagsFor(m),
 				Timestamp:  msToTime(m.GetTimestampMs()),
 				Type:       ag.DerivedCounter,
 				Value:      float64(summary.GetSampleCount()),
 				SampleRate: 1.0,
 			})
+			for _, q := range summary.GetQuantile() {
+				if !c.forwardsSummaryQuantile(q) {
+					continue
+				}
+				out = append(out, &ag.Measurement{
+					Name:       quantileName(name, q.GetQuantile()),
+					Tags:       tagsFor(m),
+					Timestamp:  msToTime(m.GetTimestampMs()),
+					Type:       ag.Gauge,
+					Value:      q.GetValue(),
+					SampleRate: 1.0,
+				})
+			}
+			ok = true
+		}
+	case dto.MetricType_UNTYPED:
+		typ := c.untypedType(name)
+		for _, m := range mf.Metric {
+			out = append(out, &ag.Measurement{
+				Name:       name,
+				Tags:       tagsFor(m),
+				Timestamp:  msToTime(m.GetTimestampMs()),
+				Type:       typ,
+				Value:      getValue(m),
+				SampleRate: 1.0,
+			})
+			ok = true
+		}
+	case dto.MetricType_HISTOGRAM:
+		for _, m := range mf.Metric {
+			out = append(out, c.histogramToMeasurements(name, m)...)
 			ok = true
 		}
 	}
 	return
 }
 
+// forwardsSummaryQuantile returns true if q is to be reported. Summaries
+// without observations report NaN, which never is.
+func (c *converter) forwardsSummaryQuantile(q *dto.Quantile) bool {
+	if math.IsNaN(q.GetValue()) {
+		return false
+	}
+	if c.summaryQuantiles == nil {
+		return true
+	}
+	for _, want := range c.summaryQuantiles {
+		if q.GetQuantile() == want {
+			return true
+		}
+	}
+	return false
+}
+
+// msToTime converts a Prometheus timestamp to a time. Scrapes rarely
+// include timestamps, so a timestamp of 0 is taken to mean now.
 func msToTime(ms int64) time.Time {
+	if ms == 0 {
+		return time.Now().UTC()
+	}
 	secs := ms / 1000
 	ns := time.Duration(ms%1000) * time.Millisecond
 	return time.Unix(secs, int64(ns)).UTC()
@@ -323,33 +444,15 @@ func getValue(m *dto.Metric) float64 {
 	return 0
 }
 
-// suffixFor returns a dot separated string of `label_values`.
-func suffixFor(m *dto.Metric) string {
-	result := make([]string, 0, len(m.Label))
-
-	for _, lp := range m.Label {
-		labelName := strings.Map(charMapper, lp.GetName())
-		labelVal := strings.Map(charMapper, lp.GetValue())
-		result = append(result, labelName+"_"+labelVal)
+// tagsFor returns the label pairs of m as Tags.
+func tagsFor(m *dto.Metric) ag.Tags {
+	if len(m.Label) == 0 {
+		return nil
 	}
 
-	if len(result) == 0 {
-		return ""
-	}
-	return "." + strings.Join(result, ".")
-}
-
-func charMapper(r rune) rune {
-	switch {
-	case r >= 'A' && r <= 'Z':
-		return r
-	case r >= 'a' && r <= 'z':
-		return r
-	case r >= '0' && r <= '9':
-		return r
-	case r == '-' || r == '_' || r == '.':
-		return r
-	default:
-		return '_'
+	result := make(ag.Tags, 0, len(m.Label))
+	for _, lp := range m.Label {
+		result = append(result, ag.Tag{Key: lp.GetName(), Value: lp.GetValue()})
 	}
+	return result
 }
@@ -34,6 +34,7 @@ import (
 	"bytes"
 	"context"
 	"log"
+	"math"
 	"net/http/httptest"
 	"net/url"
 	"testing"
@@ -74,12 +75,34 @@ func setup() (*url.URL, map[string]float64, func()) {
 	gaugeVec.WithLabelValues("pantry #1").Add(71)
 	reg.MustRegister(gaugeVec)
 
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "some_histogram",
+		Help:    "histogram help",
+		Buckets: []float64{0.1, 1},
+	})
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(2)
+	reg.MustRegister(histogram)
+
+	untyped := prometheus.NewUntypedFunc(prometheus.UntypedOpts{
+		Name: "some_untyped_total",
+		Help: "untyped help",
+	}, func() float64 { return 5 })
+	reg.MustRegister(untyped)
+
 	expectations := map[string]float64{
-		"some_counter.code_200.type_http":                1,
-		"some_counter.code_500.type_http":                1,
-		"some_gauge.location_office.type_temperature":    75,
-		"some_gauge.location_kitchen.type_temperature":   76,
-		"some_gauge.location_pantry__1.type_temperature": 71,
+		seriesKey("some_counter", "code", "200", "type", "http"):                1,
+		seriesKey("some_counter", "code", "500", "type", "http"):                1,
+		seriesKey("some_gauge", "location", "office", "type", "temperature"):    75,
+		seriesKey("some_gauge", "location", "kitchen", "type", "temperature"):   76,
+		seriesKey("some_gauge", "location", "pantry #1", "type", "temperature"): 71,
+		seriesKey("some_histogram_sum"):                                         2.55,
+		seriesKey("some_histogram_count"):                                       3,
+		seriesKey("some_histogram_bucket", "le", "0.1"):                         1,
+		seriesKey("some_histogram_bucket", "le", "1"):                           2,
+		seriesKey("some_histogram_bucket", "le", "+Inf"):                        3,
+		seriesKey("some_untyped_total"):                                         5,
 	}
 
 	buf := &bytes.Buffer{}
@@ -97,6 +120,16 @@ func setup() (*url.URL, map[string]float64, func()) {
 	}
 }
 
+// seriesKey returns the Series.Key for name, tagged with pairs of
+// keys and values.
+func seriesKey(name string, kvs ...string) string {
+	var tags am.Tags
+	for i := 0; i+1 < len(kvs); i += 2 {
+		tags = append(tags, am.Tag{Key: kvs[i], Value: kvs[i+1]})
+	}
+	return am.Series{Name: name, Tags: tags}.Key()
+}
+
 func TestPromPoller(t *testing.T) {
 	acceptHeaders := []string{
 		`text/plain; version=0.0.4`,
@@ -121,7 +154,7 @@ func TestPromPoller(t *testing.T) {
 func testPollerForType(t *testing.T, u *url.URL, exp map[string]float64, acceptHeader string) {
 	found := make(map[string]int)
 
-	in := make(chan *am.Measurement, 4)
+	in := make(chan *am.Batch, 4)
 	poller := Poller{
 		URL:          u,
 		Interval:     50 * time.Millisecond,
@@ -137,13 +170,17 @@ func testPollerForType(t *testing.T, u *url.URL, exp map[string]float64, acceptH
 
 	for {
 		select {
-		case m := <-in:
-			if val, ok := exp[m.Name]; !ok {
-				t.Fatalf("Received measurement for unexpected metric %s", m.Name)
-			} else if val != m.Value {
-				t.Fatalf("Expected want=%f, got=%f", val, m.Value)
+		case b := <-in:
+			for i := range b.Measurements {
+				m := &b.Measurements[i]
+				key := m.Series().Key()
+				if val, ok := exp[key]; !ok {
+					t.Fatalf("Received measurement for unexpected metric %s %v", m.Name, m.Tags)
+				} else if val != m.Value {
+					t.Fatalf("Expected want=%f, got=%f", val, m.Value)
+				}
+				found[key]++
 			}
-			found[m.Name]++
 		case <-timeout:
 			if len(found) != len(exp) {
 				t.Fatalf("Expectations left unsatisfied: %+v", len(exp)-len(found))
@@ -162,28 +199,30 @@ func fakeSummaryFamily() (*dto.MetricFamily, []*am.Measurement) {
 	sum := float64(20.0)
 
 	return &dto.MetricFamily{
-			Name: &name,
-			Type: &typ,
-			Metric: []*dto.Metric{
-				{
-					Label: []*dto.LabelPair{
-						&dto.LabelPair{Name: &path, Value: &index},
-					},
-					Summary: &dto.Summary{SampleCount: &cnt, SampleSum: &sum},
-				},
-			},
-		}, []*am.Measurement{
+		Name: &name,
+		Type: &typ,
+		Metric: []*dto.Metric{
 			{
-				Name:  "some_summary_sum.path_index",
-				Value: 20,
-				Type:  am.DerivedCounter,
-			},
-			{
-				Name:  "some_summary_count.path_index",
-				Value: 2,
-				Type:  am.DerivedCounter,
+				Label: []*dto.LabelPair{
+					&dto.LabelPair{Name: &path, Value: &index},
+				},
+				Summary: &dto.Summary{SampleCount: &cnt, SampleSum: &sum},
 			},
-		}
+		},
+	}, []*am.Measurement{
+		{
+			Name:  "some_summary_sum",
+			Tags:  am.Tags{{Key: "path", Value: "index"}},
+			Value: 20,
+			Type:  am.DerivedCounter,
+		},
+		{
+			Name:  "some_summary_count",
+			Tags:  am.Tags{{Key: "path", Value: "index"}},
+			Value: 2,
+			Type:  am.DerivedCounter,
+		},
+	}
 }
 
 // Summaries are time based, and so very hard to actually test as
@@ -194,7 +233,7 @@ func fakeSummaryFamily() (*dto.MetricFamily, []*am.Measurement) {
 func TestSummaryNaming(t *testing.T) {
 	family, exps := fakeSummaryFamily()
 
-	out, ok := familyToMeasurements(family)
+	out, ok := Poller{}.newConverter().familyToMeasurements(family)
 	if !ok {
 		t.Fatalf("got %t, want true", ok)
 	}
@@ -204,8 +243,8 @@ func TestSummaryNaming(t *testing.T) {
 
 	for i, got := range out {
 		want := exps[i]
-		if want.Name != got.Name {
-			t.Errorf("want(name) = %v, got(name) = %v", want.Name, got.Name)
+		if want.Series().Key() != got.Series().Key() {
+			t.Errorf("want(series) = %v, got(series) = %v", want.Series(), got.Series())
 		}
 		if want.Value != got.Value {
 			t.Errorf("want(value) = %f, got(value) = %f", want.Value, got.Value)
@@ -216,6 +255,164 @@ func TestSummaryNaming(t *testing.T) {
 	}
 }
 
+// fakeHistogramFamily returns a histogram family, with buckets bounded
+// at 0.1 and 1, and their cumulative counts.
+func fakeHistogramFamily(under01, under1, count uint64) *dto.MetricFamily {
+	name := "some_histogram"
+	typ := dto.MetricType_HISTOGRAM
+	sum := float64(count)
+	bounds := []float64{0.1, 1}
+	counts := []uint64{under01, under1}
+
+	h := &dto.Histogram{SampleCount: &count, SampleSum: &sum}
+	for i := range bounds {
+		h.Bucket = append(h.Bucket, &dto.Bucket{UpperBound: &bounds[i], CumulativeCount: &counts[i]})
+	}
+	return &dto.MetricFamily{Name: &name, Type: &typ, Metric: []*dto.Metric{{Histogram: h}}}
+}
+
+// gauges returns the values of the gauges in ms, by name.
+func gauges(ms []*am.Measurement) map[string]float64 {
+	out := make(map[string]float64)
+	for _, m := range ms {
+		if m.Type == am.Gauge {
+			out[m.Name] = m.Value
+		}
+	}
+	return out
+}
+
+func TestHistogramNaming(t *testing.T) {
+	out, ok := Poller{}.newConverter().familyToMeasurements(fakeHistogramFamily(1, 2, 3))
+	if !ok {
+		t.Fatalf("got %t, want true", ok)
+	}
+
+	exps := []*am.Measurement{
+		{Name: "some_histogram_sum", Value: 3, Type: am.DerivedCounter},
+		{Name: "some_histogram_count", Value: 3, Type: am.DerivedCounter},
+		{Name: "some_histogram_bucket", Tags: am.Tags{{Key: "le", Value: "0.1"}}, Value: 1, Type: am.DerivedCounter},
+		{Name: "some_histogram_bucket", Tags: am.Tags{{Key: "le", Value: "1"}}, Value: 2, Type: am.DerivedCounter},
+		{Name: "some_histogram_bucket", Tags: am.Tags{{Key: "le", Value: "+Inf"}}, Value: 3, Type: am.DerivedCounter},
+	}
+	if len(out) != len(exps) {
+		t.Fatalf("got len(%d), want len(%d)", len(out), len(exps))
+	}
+	for i, got := range out {
+		want := exps[i]
+		if want.Series().Key() != got.Series().Key() || want.Value != got.Value || want.Type != got.Type {
+			t.Errorf("want %+v, got %+v", want, got)
+		}
+	}
+}
+
+func TestHistogramQuantiles(t *testing.T) {
+	conv := Poller{HistogramQuantiles: []float64{0.5, 0.9}}.newConverter()
+	scrape := func(under01, under1, count uint64) map[string]float64 {
+		out, _ := conv.familyToMeasurements(fakeHistogramFamily(under01, under1, count))
+		conv.endScrape()
+		return gauges(out)
+	}
+
+	if got := scrape(1, 2, 2); len(got) != 0 {
+		t.Errorf("Expected no quantiles without a previous scrape, got %v", got)
+	}
+
+	// 10 more observations, all between 0.1 and 1.
+	got := scrape(1, 12, 12)
+	want := map[string]float64{
+		"some_histogram.quantile_0.5": 0.55,
+		"some_histogram.quantile_0.9": 0.91,
+	}
+	for name, v := range want {
+		if math.Abs(got[name]-v) > 1e-9 {
+			t.Errorf("Expected %s=%f, got %v", name, v, got)
+		}
+	}
+
+	if got := scrape(1, 12, 12); len(got) != 0 {
+		t.Errorf("Expected no quantiles without new observations, got %v", got)
+	}
+
+	// A restart resets the counts.
+	got = scrape(4, 4, 4)
+	if got["some_histogram.quantile_0.5"] != 0.05 {
+		t.Errorf("Expected quantiles of the counts since the reset, got %v", got)
+	}
+
+	// Forgotten once missing from a scrape.
+	conv.endScrape()
+	if got := scrape(5, 5, 5); len(got) != 0 {
+		t.Errorf("Expected no quantiles after a scrape without the histogram, got %v", got)
+	}
+}
+
+func TestEstimateQuantile(t *testing.T) {
+	inf := math.Inf(1)
+	cases := []struct {
+		q      float64
+		bounds []float64
+		counts []float64
+		total  float64
+		want   float64
+	}{
+		{0.5, []float64{1, 2, inf}, []float64{2, 4, 4}, 4, 1},
+		{0.75, []float64{1, 2, inf}, []float64{2, 4, 4}, 4, 1.5},
+		{0.99, []float64{1, 2, inf}, []float64{2, 2, 4}, 4, 2},
+		{0.5, []float64{-1, 2, inf}, []float64{4, 4, 4}, 4, -1},
+		{0.5, []float64{1, 2}, []float64{0, 1}, 4, 2},
+	}
+	for _, c := range cases {
+		if got := estimateQuantile(c.q, c.bounds, c.counts, c.total); got != c.want {
+			t.Errorf("estimateQuantile(%v, %v, %v, %v) = %v, want %v", c.q, c.bounds, c.counts, c.total, got, c.want)
+		}
+	}
+
+	if got := estimateQuantile(0.5, []float64{inf}, []float64{4}, 4); !math.IsNaN(got) {
+		t.Errorf("Expected NaN with only a +Inf bucket, got %v", got)
+	}
+}
+
+func TestSummaryQuantiles(t *testing.T) {
+	family, _ := fakeSummaryFamily()
+	qs := []float64{0.5, 0.9, 0.99}
+	vs := []float64{3, 8, math.NaN()}
+	for i := range qs {
+		family.Metric[0].Summary.Quantile = append(family.Metric[0].Summary.Quantile,
+			&dto.Quantile{Quantile: &qs[i], Value: &vs[i]})
+	}
+
+	out, _ := Poller{}.newConverter().familyToMeasurements(family)
+	got := gauges(out)
+	want := map[string]float64{
+		"some_summary.quantile_0.5": 3,
+		"some_summary.quantile_0.9": 8,
+	}
+	if len(got) != len(want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	for name, v := range want {
+		if got[name] != v {
+			t.Errorf("Expected %s=%f, got %v", name, v, got)
+		}
+	}
+	for _, m := range out {
+		if m.Type == am.Gauge && m.Series().Key() != seriesKey(m.Name, "path", "index") {
+			t.Errorf("Expected the summary's tags, got %v", m.Tags)
+		}
+	}
+
+	out, _ = Poller{SummaryQuantiles: []float64{0.9}}.newConverter().familyToMeasurements(family)
+	if got := gauges(out); len(got) != 1 || got["some_summary.quantile_0.9"] != 8 {
+		t.Errorf("Expected only the 0.9 quantile, got %v", got)
+	}
+
+	out, _ = Poller{SummaryQuantiles: []float64{}}.newConverter().familyToMeasurements(family)
+	if got := gauges(out); len(got) != 0 {
+		t.Errorf("Expected no quantiles, got %v", got)
+	}
+}
+
 func fakeCounterFamily() (*dto.MetricFamily, []*am.Measurement) {
 	sc := "some_counter"
 	mt := dto.MetricType_COUNTER
@@ -227,85 +424,85 @@ func fakeCounterFamily() (*dto.MetricFamily, []*am.Measurement) {
 	one := float64(1)
 
 	return &dto.MetricFamily{
-			Name: &sc,
-			Type: &mt,
-			Metric: []*dto.Metric{
-				{
-					Label: []*dto.LabelPair{
-						&dto.LabelPair{Name: &code, Value: &t00},
-						&dto.LabelPair{Name: &typ, Value: &htp},
-					},
-					Counter: &dto.Counter{Value: &one},
-				},
-				{
-					Label: []*dto.LabelPair{
-						&dto.LabelPair{Name: &code, Value: &f00},
-						&dto.LabelPair{Name: &typ, Value: &htp},
-					},
-					Counter: &dto.Counter{Value: &one},
-				},
-			},
-		}, []*am.Measurement{
+		Name: &sc,
+		Type: &mt,
+		Metric: []*dto.Metric{
 			{
-				Name:  "some_counter.code_200.type_http",
-				Value: 1,
-				Type:  am.DerivedCounter,
+				Label: []*dto.LabelPair{
+					&dto.LabelPair{Name: &code, Value: &t00},
+					&dto.LabelPair{Name: &typ, Value: &htp},
+				},
+				Counter: &dto.Counter{Value: &one},
 			},
 			{
-				Name:  "some_counter.code_500.type_http",
-				Value: 1,
-				Type:  am.DerivedCounter,
+				Label: []*dto.LabelPair{
+					&dto.LabelPair{Name: &code, Value: &f00},
+					&dto.LabelPair{Name: &typ, Value: &htp},
+				},
+				Counter: &dto.Counter{Value: &one},
 			},
-		}
+		},
+	}, []*am.Measurement{
+		{
+			Name:  "some_counter",
+			Tags:  am.Tags{{Key: "code", Value: "200"}, {Key: "type", Value: "http"}},
+			Value: 1,
+			Type:  am.DerivedCounter,
+		},
+		{
+			Name:  "some_counter",
+			Tags:  am.Tags{{Key: "code", Value: "500"}, {Key: "type", Value: "http"}},
+			Value: 1,
+			Type:  am.DerivedCounter,
+		},
+	}
 
 }
 
 func TestPollerSync(t *testing.T) {
 	mf, expected := fakeCounterFamily()
 
-	inbox := make(chan *am.Measurement, 2)
+	inbox := make(chan *am.Batch, 2)
 	poller := Poller{Inbox: inbox}
 
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	ch := make(chan *dto.MetricFamily, 1)
-	go poller.sync(ctx, ch)
+	go poller.sync(ctx, ch, poller.newConverter())
 	ch <- mf
+	close(ch)
 
-	ei := 0
-
-loop:
-	for {
-		select {
-		case m := <-inbox:
-			if expected[ei].Name != m.Name {
-				t.Errorf("Expected name=%q got=%q", expected[ei].Name, m.Name)
-			}
-			if expected[ei].Value != m.Value {
-				t.Errorf("Expected name=%f got=%f", expected[ei].Value, m.Value)
-			}
-			if expected[ei].Type != m.Type {
-				t.Errorf("Expected type=%q got=%q", expected[ei].Type, m.Type)
-			}
-			ei++
+	var b *am.Batch
+	select {
+	case b = <-inbox:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a batch once the scrape was done")
+	}
 
-		case <-time.After(1 * time.Millisecond):
-			if len(expected) != ei {
-				t.Fatalf("Expected to receive %d measurements, found %d", len(expected), ei)
-			}
-			break loop
+	if len(expected) != b.Len() {
+		t.Fatalf("Expected to receive %d measurements, found %d", len(expected), b.Len())
+	}
+	for ei := range b.Measurements {
+		m := &b.Measurements[ei]
+		if expected[ei].Series().Key() != m.Series().Key() {
+			t.Errorf("Expected series=%v got=%v", expected[ei].Series(), m.Series())
+		}
+		if expected[ei].Value != m.Value {
+			t.Errorf("Expected name=%f got=%f", expected[ei].Value, m.Value)
+		}
+		if expected[ei].Type != m.Type {
+			t.Errorf("Expected type=%q got=%q", expected[ei].Type, m.Type)
 		}
 	}
-
-	cancel()
 }
 
 func TestPollerSyncCancel(t *testing.T) {
-	inbox := make(chan *am.Measurement, 2)
+	inbox := make(chan *am.Batch, 2)
 	poller := Poller{Inbox: inbox}
 	ctx, cancel := context.WithCancel(context.Background())
 	ch := make(chan *dto.MetricFamily, 1)
 	cancel()
-	go poller.sync(ctx, ch)
+	go poller.sync(ctx, ch, poller.newConverter())
 
 	select {
 	case m := <-inbox:
@@ -313,3 +510,54 @@ func TestPollerSyncCancel(t *testing.T) {
 	case <-time.After(10 * time.Millisecond):
 	}
 }
+
+func TestPollerSyncDropNewest(t *testing.T) {
+	mf, expected := fakeCounterFamily()
+
+	inbox := make(chan *am.Batch, 1)
+	stats := am.NewStats()
+	poller := Poller{Inbox: inbox, Backpressure: am.DropNewest, Stats: stats}
+
+	// Leave no room for the scrape.
+	inbox <- am.NewBatch()
+
+	ch := make(chan *dto.MetricFamily, 1)
+	ch <- mf
+	close(ch)
+	poller.sync(context.Background(), ch, poller.newConverter())
+
+	dropped := stats.Counter(am.DroppedMetricName,
+		am.Tag{Key: "source", Value: "prom"}, am.Tag{Key: "policy", Value: "drop-newest"})
+	if got := dropped.Value(); got != uint64(len(expected)) {
+		t.Errorf("Expected %d dropped, got %d", len(expected), got)
+	}
+}
+
+func BenchmarkPollerSync(b *testing.B) {
+	mf, expected := fakeCounterFamily()
+
+	inbox := make(chan *am.Batch, 1)
+	poller := Poller{Inbox: inbox}
+	done := make(chan struct{})
+	go func() {
+		for batch := range inbox {
+			batch.Release()
+		}
+		close(done)
+	}()
+
+	conv := poller.newConverter()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ch := make(chan *dto.MetricFamily, 1)
+		ch <- mf
+		close(ch)
+		poller.sync(context.Background(), ch, conv)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(b.N*len(expected))/b.Elapsed().Seconds(), "measurements/s")
+
+	close(inbox)
+	<-done
+}
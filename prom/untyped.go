@@ -0,0 +1,81 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package prom
+
+import (
+	"fmt"
+	"strings"
+
+	ag "github.com/heroku/agentmon"
+)
+
+var untypedTypes = map[string]ag.MetricType{
+	"counter": ag.DerivedCounter,
+	"gauge":   ag.Gauge,
+}
+
+// ParseUntypedTypes parses comma separated `name=type` pairs, where type
+// is counter or gauge, into a map suitable for Poller.UntypedTypes.
+func ParseUntypedTypes(s string) (map[string]ag.MetricType, error) {
+	out := make(map[string]ag.MetricType)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		i := strings.LastIndexByte(pair, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("expected `name=type`, got %q", pair)
+		}
+		name, typ := pair[:i], pair[i+1:]
+
+		t, ok := untypedTypes[typ]
+		if !ok {
+			return nil, fmt.Errorf("unknown type %q for %q", typ, name)
+		}
+		out[name] = t
+	}
+	return out, nil
+}
+
+// untypedType returns the type to convert the untyped family name as.
+// Unless overridden, families named like counters, ending in _total,
+// are derived counters, and anything else is a gauge.
+func (c *converter) untypedType(name string) ag.MetricType {
+	if t, ok := c.untypedTypes[name]; ok {
+		return t
+	}
+	if strings.HasSuffix(name, "_total") {
+		return ag.DerivedCounter
+	}
+	return ag.Gauge
+}
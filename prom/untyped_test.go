@@ -0,0 +1,72 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package prom
+
+import (
+	"testing"
+
+	ag "github.com/heroku/agentmon"
+)
+
+func TestParseUntypedTypes(t *testing.T) {
+	types, err := ParseUntypedTypes("process_cpu_seconds=counter, jobs_total=gauge,")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(types) != 2 || types["process_cpu_seconds"] != ag.DerivedCounter || types["jobs_total"] != ag.Gauge {
+		t.Errorf("Unexpected types: %v", types)
+	}
+
+	for _, bad := range []string{"process_cpu_seconds", "=gauge", "jobs=timer"} {
+		if _, err := ParseUntypedTypes(bad); err == nil {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestUntypedType(t *testing.T) {
+	conv := Poller{UntypedTypes: map[string]ag.MetricType{
+		"process_cpu_seconds": ag.DerivedCounter,
+		"jobs_total":          ag.Gauge,
+	}}.newConverter()
+
+	cases := map[string]ag.MetricType{
+		"queue_depth":         ag.Gauge,
+		"requests_total":      ag.DerivedCounter,
+		"process_cpu_seconds": ag.DerivedCounter,
+		"jobs_total":          ag.Gauge,
+	}
+	for name, want := range cases {
+		if got := conv.untypedType(name); got != want {
+			t.Errorf("untypedType(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
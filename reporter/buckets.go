@@ -0,0 +1,163 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package reporter
+
+import (
+	"sort"
+	"time"
+
+	am "github.com/heroku/agentmon"
+)
+
+// LateMetricName is the name of the counter of measurements that
+// arrived after the interval they're timestamped in was flushed.
+const LateMetricName = "agentmon.late"
+
+// buckets accumulates measurements into a MetricSet per flush interval.
+// Normally, measurements go into whichever interval is open when they
+// arrive. When byTimestamp is set, each goes into the interval its
+// Timestamp falls in, which stays open until lateness after it ends.
+type buckets struct {
+	interval    time.Duration
+	lateness    time.Duration
+	byTimestamp bool
+	late        *am.StatCounter
+
+	// open buckets, oldest first.
+	open []*bucket
+
+	// parent is the MetricSet most recently closed.
+	parent *am.MetricSet
+
+	// closedUntil is the end of the newest bucket closed.
+	closedUntil time.Time
+}
+
+// bucket is the MetricSet of the interval starting at start, or, when
+// not bucketing by timestamp, of whatever interval is open.
+type bucket struct {
+	start time.Time
+	set   *am.MetricSet
+}
+
+func newBuckets(interval, lateness time.Duration, byTimestamp bool, stats *am.Stats) *buckets {
+	b := &buckets{interval: interval, lateness: lateness, byTimestamp: byTimestamp}
+	if byTimestamp {
+		b.late = stats.Counter(LateMetricName)
+	}
+	return b
+}
+
+// updateBatch adds the measurements in batch to the buckets they belong
+// in, as of now.
+func (b *buckets) updateBatch(batch *am.Batch, now time.Time) {
+	if !b.byTimestamp {
+		b.bucketAt(time.Time{}).set.UpdateBatch(batch)
+		return
+	}
+
+	for i := range batch.Measurements {
+		b.update(&batch.Measurements[i], now)
+	}
+}
+
+// update adds m to the bucket for the interval of its Timestamp, as of
+// now. Measurements without a Timestamp, or timestamped in the future,
+// are taken to be from now.
+func (b *buckets) update(m *am.Measurement, now time.Time) {
+	ts := m.Timestamp
+	if ts.IsZero() || ts.After(now) {
+		ts = now
+	}
+
+	start := ts.Truncate(b.interval)
+	if start.Before(b.closedUntil) || !now.Before(start.Add(b.interval+b.lateness)) {
+		b.late.Add(1)
+		return
+	}
+	b.bucketAt(start).set.Update(m)
+}
+
+// bucketAt returns the open bucket starting at start, opening it if
+// necessary.
+func (b *buckets) bucketAt(start time.Time) *bucket {
+	i := sort.Search(len(b.open), func(i int) bool {
+		return !b.open[i].start.Before(start)
+	})
+	if i < len(b.open) && b.open[i].start.Equal(start) {
+		return b.open[i]
+	}
+
+	parent := b.parent
+	if i > 0 {
+		parent = b.open[i-1].set
+	}
+	bk := &bucket{start: start, set: am.NewMetricSet(parent)}
+
+	b.open = append(b.open, nil)
+	copy(b.open[i+1:], b.open[i:])
+	b.open[i] = bk
+	return bk
+}
+
+// close removes, and returns snapshots of, the buckets due to be
+// flushed by now. That's whatever is open, or, when bucketing by
+// timestamp, the buckets whose intervals ended at least lateness ago.
+func (b *buckets) close(now time.Time) []*bucket {
+	if !b.byTimestamp {
+		b.bucketAt(time.Time{})
+		return b.closeFirst(len(b.open))
+	}
+
+	n := sort.Search(len(b.open), func(i int) bool {
+		return now.Before(b.open[i].start.Add(b.interval + b.lateness))
+	})
+	return b.closeFirst(n)
+}
+
+// closeAll removes, and returns snapshots of, every open bucket.
+func (b *buckets) closeAll() []*bucket {
+	return b.closeFirst(len(b.open))
+}
+
+func (b *buckets) closeFirst(n int) []*bucket {
+	closed := make([]*bucket, n)
+	for i, bk := range b.open[:n] {
+		closed[i] = &bucket{start: bk.start, set: bk.set.Snapshot()}
+		b.parent = closed[i].set
+	}
+	if n > 0 && b.byTimestamp {
+		b.closedUntil = closed[n-1].start.Add(b.interval)
+	}
+
+	b.open = append(b.open[:0], b.open[n:]...)
+	return closed
+}
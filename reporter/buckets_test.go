@@ -0,0 +1,114 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package reporter
+
+import (
+	"testing"
+	"time"
+
+	am "github.com/heroku/agentmon"
+)
+
+func TestBucketsByTimestamp(t *testing.T) {
+	start := time.Unix(1500000000, 0).Truncate(10 * time.Second)
+	stats := am.NewStats()
+	b := newBuckets(10*time.Second, 5*time.Second, true, stats)
+
+	now := start.Add(12 * time.Second)
+	b.update(&am.Measurement{Name: "gorets", Type: am.Counter, Value: 1, SampleRate: 1, Timestamp: start.Add(time.Second)}, now)
+	b.update(&am.Measurement{Name: "gorets", Type: am.Counter, Value: 2, SampleRate: 1, Timestamp: start.Add(11 * time.Second)}, now)
+	b.update(&am.Measurement{Name: "gorets", Type: am.Counter, Value: 4, SampleRate: 1}, now)
+
+	if closed := b.close(start.Add(14 * time.Second)); len(closed) != 0 {
+		t.Fatalf("Expected nothing to close within the lateness window, got %d buckets", len(closed))
+	}
+
+	closed := b.close(start.Add(15 * time.Second))
+	if len(closed) != 1 {
+		t.Fatalf("Expected 1 bucket to close, got %d", len(closed))
+	}
+	if !closed[0].start.Equal(start) || closed[0].set.Counters["gorets"] != 1 {
+		t.Errorf("Unexpected bucket at %v: %+v", closed[0].start, closed[0].set.Counters)
+	}
+
+	closed = b.closeAll()
+	if len(closed) != 1 {
+		t.Fatalf("Expected 1 bucket left open, got %d", len(closed))
+	}
+	if !closed[0].start.Equal(start.Add(10*time.Second)) || closed[0].set.Counters["gorets"] != 6 {
+		t.Errorf("Unexpected bucket at %v: %+v", closed[0].start, closed[0].set.Counters)
+	}
+
+	if v := stats.Counter(LateMetricName).Value(); v != 0 {
+		t.Errorf("Expected no late measurements, got %d", v)
+	}
+}
+
+func TestBucketsLate(t *testing.T) {
+	start := time.Unix(1500000000, 0).Truncate(10 * time.Second)
+	stats := am.NewStats()
+	b := newBuckets(10*time.Second, 5*time.Second, true, stats)
+
+	// Past the lateness window of its interval.
+	b.update(&am.Measurement{Name: "gorets", Type: am.Counter, Value: 1, SampleRate: 1, Timestamp: start}, start.Add(15*time.Second))
+
+	// In an interval that's already been flushed.
+	b.update(&am.Measurement{Name: "gorets", Type: am.Counter, Value: 1, SampleRate: 1, Timestamp: start.Add(20 * time.Second)}, start.Add(21*time.Second))
+	b.close(start.Add(35 * time.Second))
+	b.update(&am.Measurement{Name: "gorets", Type: am.Counter, Value: 1, SampleRate: 1, Timestamp: start.Add(10 * time.Second)}, start.Add(22*time.Second))
+
+	if v := stats.Counter(LateMetricName).Value(); v != 2 {
+		t.Errorf("Expected 2 late measurements, got %d", v)
+	}
+}
+
+func TestBucketsByArrival(t *testing.T) {
+	stats := am.NewStats()
+	b := newBuckets(10*time.Second, 5*time.Second, false, stats)
+	now := time.Now()
+
+	b.updateBatch(batchOf(
+		&am.Measurement{Name: "gorets", Type: am.Counter, Value: 1, SampleRate: 1, Timestamp: now.Add(-time.Hour)},
+		&am.Measurement{Name: "gorets", Type: am.Counter, Value: 2, SampleRate: 1},
+	), now)
+
+	closed := b.close(now)
+	if len(closed) != 1 || closed[0].set.Counters["gorets"] != 3 {
+		t.Fatalf("Expected everything in one bucket, got %+v", closed)
+	}
+	if !closed[0].start.IsZero() {
+		t.Errorf("Expected the bucket to be flushed as of now, got %v", closed[0].start)
+	}
+
+	if closed := b.close(now); len(closed) != 1 || len(closed[0].set.Counters) != 0 {
+		t.Errorf("Expected an empty bucket for an idle interval, got %+v", closed)
+	}
+}
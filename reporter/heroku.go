@@ -37,6 +37,8 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	am "github.com/heroku/agentmon"
@@ -44,6 +46,7 @@ import (
 
 const (
 	defaultHerokuReporterInterval = 20 * time.Second
+	defaultHerokuShutdownTimeout  = 10 * time.Second
 
 	headerMeasurementsCount = "Measurements-Count"
 	headerMeasurementsTime  = "Measurements-Time"
@@ -59,23 +62,61 @@ type Heroku struct {
 	// MetricSet.
 	Interval time.Duration
 
-	// Inbox is the channel Measurements from pollers and listeners are
-	// received on.
-	Inbox chan *am.Measurement
+	// Inbox is the channel Batches of Measurements from pollers and
+	// listeners are received on.
+	Inbox chan *am.Batch
+
+	// Quantiles are the quantiles, between 0 and 1, estimated for each
+	// timer and reported as gauges. Defaults to p50, p95, and p99.
+	Quantiles []float64
+
+	// Stats, if set, are self-metrics reported along with each
+	// MetricSet.
+	Stats *am.Stats
+
+	// BucketByTimestamp adds each Measurement to the MetricSet for the
+	// interval its Timestamp falls in, rather than whichever is open
+	// when it arrives. Intervals are aligned to multiples of Interval,
+	// and flushed once Lateness has passed since they ended. Later
+	// measurements are dropped, and counted by LateMetricName.
+	BucketByTimestamp bool
+	Lateness          time.Duration
+
+	// ShutdownTimeout bounds how long Report waits, once ctx is done,
+	// for the final flush and any others still in flight. Defaults to
+	// 10 seconds.
+	ShutdownTimeout time.Duration
 
 	// Debug turns on more verbose logging.
 	Debug bool
 }
 
+var defaultHerokuQuantiles = []float64{0.5, 0.95, 0.99}
+
 // Report reads measurements from Inbox, and produces MetricSets that get
-// sent to the Heroku metrics service.
+// sent to the Heroku metrics service. Once ctx is done, whatever is left
+// in Inbox is added to the current MetricSet, which is flushed before
+// Report returns. Sources should be stopped before ctx is cancelled, so
+// that nothing they send is lost.
 func (r Heroku) Report(ctx context.Context) {
 	if r.Interval <= 0 {
 		r.Interval = defaultHerokuReporterInterval
 	}
+	if r.Quantiles == nil {
+		r.Quantiles = defaultHerokuQuantiles
+	}
+	if r.ShutdownTimeout <= 0 {
+		r.ShutdownTimeout = defaultHerokuShutdownTimeout
+	}
+
+	// Flushes outlive ctx, so that the final ones can complete.
+	flushCtx, cancelFlushes := context.WithCancel(context.Background())
+	defer cancelFlushes()
+	var flushes sync.WaitGroup
 
-	currentSet := am.NewMetricSet(nil)
-	ticks := time.Tick(r.Interval)
+	buckets := newBuckets(r.Interval, r.Lateness, r.BucketByTimestamp, r.Stats)
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
 
 	for {
 		select {
@@ -83,28 +124,184 @@ func (r Heroku) Report(ctx context.Context) {
 			if r.Debug {
 				log.Println("debug: stopping HerokuReporter loop")
 			}
+			r.drain(buckets)
+
+			deadline := time.AfterFunc(r.ShutdownTimeout, cancelFlushes)
+			r.flushAll(flushCtx, r.collect(buckets.closeAll()))
+			flushes.Wait()
+			deadline.Stop()
+			return
+		case b := <-r.Inbox:
+			r.update(buckets, b)
+		case <-ticker.C:
+			closed := r.collect(buckets.close(time.Now()))
+			flushes.Add(1)
+			go func() {
+				defer flushes.Done()
+				r.flushAll(flushCtx, closed)
+			}()
+		}
+	}
+}
+
+// drain adds the measurements already buffered in Inbox to buckets.
+func (r Heroku) drain(buckets *buckets) {
+	for {
+		select {
+		case b := <-r.Inbox:
+			r.update(buckets, b)
+		default:
 			return
-		case m := <-r.Inbox:
-			currentSet.Update(m)
-		case <-ticks:
-			flushSet := currentSet.Snapshot()
-			currentSet = am.NewMetricSet(flushSet)
-			go r.flush(ctx, flushSet)
 		}
 	}
 }
 
-func (r Heroku) flush(ctx context.Context, set *am.MetricSet) {
-	l := set.Len()
-	if l == 0 {
+// update adds b to buckets, and releases it.
+func (r Heroku) update(buckets *buckets, b *am.Batch) {
+	buckets.updateBatch(b, time.Now())
+	b.Release()
+}
+
+// collect adds the growth of Stats since the last flush to the newest
+// of closed, if any, and returns closed.
+func (r Heroku) collect(closed []*bucket) []*bucket {
+	if len(closed) == 0 {
+		return closed
+	}
+
+	set := closed[len(closed)-1].set
+	for _, m := range r.Stats.Collect() {
+		set.Update(m)
+	}
+	return closed
+}
+
+// flushAll flushes each of closed, in order.
+func (r Heroku) flushAll(ctx context.Context, closed []*bucket) {
+	for _, bk := range closed {
+		r.flush(ctx, bk.set, bk.start)
+	}
+}
+
+// herokuPayload is the JSON body understood by the Heroku metrics
+// service, which only knows about counters and gauges.
+type herokuPayload struct {
+	Counters map[string]float64 `json:"counters,omitempty"`
+	Gauges   map[string]float64 `json:"gauges,omitempty"`
+}
+
+// newHerokuPayload renders set as a herokuPayload. Timers are expanded
+// into derived metrics: `name.count`, `name.sum`, and `name.sumsq` are
+// reported as counters, while `name.min`, `name.max`, and a gauge per
+// quantile (e.g. `name.p99`) are reported as gauges. Histograms and
+// distributions are reported the same way, but only as `name.count`,
+// `name.sum`, and the quantile gauges. Sets are reported as a gauge of
+// the estimated number of distinct members.
+func newHerokuPayload(set *am.MetricSet, quantiles []float64) herokuPayload {
+	out := herokuPayload{
+		Counters: make(map[string]float64, len(set.Counters)),
+		Gauges:   make(map[string]float64, len(set.Gauges)),
+	}
+	for k, v := range set.Counters {
+		out.Counters[herokuName(set.Series(k))] = v
+	}
+	for k, v := range set.Gauges {
+		out.Gauges[herokuName(set.Series(k))] = v
+	}
+	for k, v := range set.Timers {
+		k = herokuName(set.Series(k))
+		out.Counters[k+".count"] = v.Count
+		out.Counters[k+".sum"] = v.Sum
+		out.Counters[k+".sumsq"] = v.SumSquares
+		out.Gauges[k+".min"] = v.Min
+		out.Gauges[k+".max"] = v.Max
+		for _, q := range quantiles {
+			out.Gauges[k+"."+quantileSuffix(q)] = v.Quantile(q)
+		}
+	}
+	for k, v := range set.Distributions {
+		k = herokuName(set.Series(k))
+		out.Counters[k+".count"] = v.Count
+		out.Counters[k+".sum"] = v.Sum
+		for _, q := range quantiles {
+			out.Gauges[k+"."+quantileSuffix(q)] = v.Quantile(q)
+		}
+	}
+	for k, v := range set.Sets {
+		out.Gauges[herokuName(set.Series(k))] = float64(v.Count())
+	}
+	return out
+}
+
+// herokuName flattens a Series into a statsd style name, which is what
+// the Heroku metrics service expects. Each tag is appended, in sorted
+// order, as a `.key_value` segment (or `.key` if it has no value), with
+// characters other than [a-zA-Z0-9._-] replaced by `_`.
+func herokuName(s am.Series) string {
+	if len(s.Tags) == 0 {
+		return s.Name
+	}
+
+	var b strings.Builder
+	b.WriteString(s.Name)
+	for _, t := range s.Tags.Sorted() {
+		b.WriteByte('.')
+		b.WriteString(strings.Map(charMapper, t.Key))
+		if t.Value != "" {
+			b.WriteByte('_')
+			b.WriteString(strings.Map(charMapper, t.Value))
+		}
+	}
+	return b.String()
+}
+
+func charMapper(r rune) rune {
+	switch {
+	case r >= 'A' && r <= 'Z':
+		return r
+	case r >= 'a' && r <= 'z':
+		return r
+	case r >= '0' && r <= '9':
+		return r
+	case r == '-' || r == '_' || r == '.':
+		return r
+	default:
+		return '_'
+	}
+}
+
+// quantileSuffix names a quantile as a percentile without any dots,
+// e.g. 0.99 is "p99", and 0.999 is "p999".
+func quantileSuffix(q float64) string {
+	if q >= 1 {
+		return "p100"
+	}
+	digits := strings.TrimPrefix(strconv.FormatFloat(q, 'f', -1, 64), "0.")
+	for len(digits) < 2 {
+		digits += "0"
+	}
+	return "p" + digits
+}
+
+// Len returns the number of metrics in the payload.
+func (p herokuPayload) Len() int {
+	return len(p.Counters) + len(p.Gauges)
+}
+
+// flush sends set, as of at, or now if at is zero, to Heroku.
+func (r Heroku) flush(ctx context.Context, set *am.MetricSet, at time.Time) {
+	if set.Len() == 0 {
 		return
 	}
 
+	payload := newHerokuPayload(set, r.Quantiles)
+	l := payload.Len()
+
 	var buffer bytes.Buffer
 	enc := json.NewEncoder(&buffer)
-	err := enc.Encode(set)
+	err := enc.Encode(payload)
 	if err != nil {
-		log.Printf("flush: encode: %s: %#v", err, set)
+		log.Printf("flush: encode: %s: %#v", err, payload)
 		return
 	}
 
@@ -114,10 +311,12 @@ func (r Heroku) flush(ctx context.Context, set *am.MetricSet) {
 		return
 	}
 
-	now := time.Now().UTC()
+	if at.IsZero() {
+		at = time.Now()
+	}
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add(headerMeasurementsCount, strconv.Itoa(l))
-	req.Header.Add(headerMeasurementsTime, now.Format(time.RFC3339))
+	req.Header.Add(headerMeasurementsTime, at.UTC().Format(time.RFC3339))
 
 	// send() will retry, but we should probably give up at some point...
 	ctx, cancel := context.WithTimeout(ctx, r.Interval*2)
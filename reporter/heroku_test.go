@@ -33,7 +33,11 @@ package reporter
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
@@ -41,8 +45,16 @@ import (
 	am "github.com/heroku/agentmon"
 )
 
+func batchOf(ms ...*am.Measurement) *am.Batch {
+	b := am.NewBatch()
+	for _, m := range ms {
+		b.Add(m)
+	}
+	return b
+}
+
 func TestReporterLoopCancel(t *testing.T) {
-	inbox := make(chan *am.Measurement, 1)
+	inbox := make(chan *am.Batch, 1)
 	reporter := Heroku{Interval: time.Duration(1), Inbox: inbox}
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -83,3 +95,227 @@ func TestReporterLoopCancel(t *testing.T) {
 		close(lines)
 	}
 }
+
+func TestReporterFinalFlush(t *testing.T) {
+	bodies := make(chan herokuPayload, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p herokuPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Errorf("decode: %s", err)
+		}
+		bodies <- p
+	}))
+	defer server.Close()
+
+	inbox := make(chan *am.Batch, 2)
+	stats := am.NewStats()
+	stats.Counter("agentmon.test").Add(3)
+	reporter := Heroku{URL: server.URL, Interval: time.Hour, Inbox: inbox, Stats: stats}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Still buffered when the reporter is told to stop.
+	inbox <- batchOf(&am.Measurement{Name: "gorets", Type: am.Counter, Value: 2, SampleRate: 1})
+	inbox <- batchOf(&am.Measurement{Name: "gaugor", Type: am.Gauge, Value: 333, SampleRate: 1})
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		reporter.Report(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Report to return after its final flush")
+	}
+
+	select {
+	case p := <-bodies:
+		if p.Counters["gorets"] != 2 || p.Gauges["gaugor"] != 333 || p.Counters["agentmon.test"] != 3 {
+			t.Errorf("Unexpected final flush: %+v", p)
+		}
+	default:
+		t.Fatal("Expected a final flush")
+	}
+}
+
+func TestReporterShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	inbox := make(chan *am.Batch, 1)
+	reporter := Heroku{
+		URL:             server.URL,
+		Interval:        time.Hour,
+		Inbox:           inbox,
+		ShutdownTimeout: 10 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	inbox <- batchOf(&am.Measurement{Name: "gorets", Type: am.Counter, Value: 1, SampleRate: 1})
+	cancel()
+
+	// Silence the failed send.
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	done := make(chan struct{})
+	go func() {
+		reporter.Report(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Report to give up on its final flush")
+	}
+}
+
+func TestHerokuPayloadTimers(t *testing.T) {
+	set := am.NewMetricSet(nil)
+	set.Update(&am.Measurement{Name: "foo", Type: am.Counter, Value: 1, SampleRate: 1})
+	set.Update(&am.Measurement{Name: "req", Type: am.Timer, Value: 10, SampleRate: 1})
+	set.Update(&am.Measurement{Name: "req", Type: am.Timer, Value: 20, SampleRate: 1})
+
+	payload := newHerokuPayload(set, nil)
+
+	counters := map[string]float64{
+		"foo":       1,
+		"req.count": 2,
+		"req.sum":   30,
+		"req.sumsq": 500,
+	}
+	gauges := map[string]float64{
+		"req.min": 10,
+		"req.max": 20,
+	}
+
+	for k, want := range counters {
+		if got, ok := payload.Counters[k]; !ok || got != want {
+			t.Errorf("counter %s: got %f (present=%t), want %f", k, got, ok, want)
+		}
+	}
+	for k, want := range gauges {
+		if got, ok := payload.Gauges[k]; !ok || got != want {
+			t.Errorf("gauge %s: got %f (present=%t), want %f", k, got, ok, want)
+		}
+	}
+	if payload.Len() != len(counters)+len(gauges) {
+		t.Errorf("got len %d, want %d", payload.Len(), len(counters)+len(gauges))
+	}
+}
+
+func TestHerokuPayloadQuantiles(t *testing.T) {
+	set := am.NewMetricSet(nil)
+	for i := 1; i <= 100; i++ {
+		set.Update(&am.Measurement{Name: "req", Type: am.Timer, Value: float64(i), SampleRate: 1})
+	}
+
+	payload := newHerokuPayload(set, []float64{0.5, 0.99, 0.999})
+
+	for name, want := range map[string]float64{
+		"req.p50":  50,
+		"req.p99":  99,
+		"req.p999": 100,
+	} {
+		got, ok := payload.Gauges[name]
+		if !ok {
+			t.Errorf("missing gauge %s", name)
+			continue
+		}
+		if diff := (got - want) / want; diff > 0.01 || diff < -0.01 {
+			t.Errorf("gauge %s: got %f, want %f within 1%%", name, got, want)
+		}
+	}
+}
+
+func TestQuantileSuffix(t *testing.T) {
+	for q, want := range map[float64]string{
+		0.5:    "p50",
+		0.95:   "p95",
+		0.99:   "p99",
+		0.999:  "p999",
+		0.9999: "p9999",
+		0.29:   "p29",
+		1:      "p100",
+	} {
+		if got := quantileSuffix(q); got != want {
+			t.Errorf("quantileSuffix(%v): got %q, want %q", q, got, want)
+		}
+	}
+}
+
+func TestHerokuPayloadDistributions(t *testing.T) {
+	set := am.NewMetricSet(nil)
+	for i := 1; i <= 100; i++ {
+		set.Update(&am.Measurement{Name: "size", Type: am.Histogram, Value: float64(i), SampleRate: 1})
+	}
+
+	payload := newHerokuPayload(set, []float64{0.5})
+
+	if payload.Counters["size.count"] != 100 || payload.Counters["size.sum"] != 5050 {
+		t.Errorf("got count=%f sum=%f, want 100 and 5050", payload.Counters["size.count"], payload.Counters["size.sum"])
+	}
+	if got := payload.Gauges["size.p50"]; got < 49.5 || got > 50.5 {
+		t.Errorf("got p50 %f, want ~50", got)
+	}
+	if payload.Len() != 3 {
+		t.Errorf("got len %d, want only count, sum, and p50", payload.Len())
+	}
+}
+
+func TestHerokuPayloadSets(t *testing.T) {
+	set := am.NewMetricSet(nil)
+	for _, member := range []string{"a", "b", "a"} {
+		set.Update(&am.Measurement{Name: "users", Type: am.Set, Member: member, SampleRate: 1})
+	}
+
+	payload := newHerokuPayload(set, nil)
+
+	if got := payload.Gauges["users"]; got != 2 {
+		t.Errorf("got %f, want 2", got)
+	}
+}
+
+func TestHerokuName(t *testing.T) {
+	for _, tc := range []struct {
+		series am.Series
+		want   string
+	}{
+		{am.Series{Name: "foo"}, "foo"},
+		{
+			am.Series{Name: "some_gauge", Tags: am.Tags{
+				{Key: "type", Value: "temperature"},
+				{Key: "location", Value: "pantry #1"},
+			}},
+			"some_gauge.location_pantry__1.type_temperature",
+		},
+		{
+			am.Series{Name: "foo", Tags: am.Tags{{Key: "canary"}}},
+			"foo.canary",
+		},
+	} {
+		if got := herokuName(tc.series); got != tc.want {
+			t.Errorf("got %q, want %q", got, tc.want)
+		}
+	}
+}
+
+func TestHerokuPayloadTags(t *testing.T) {
+	set := am.NewMetricSet(nil)
+	set.Update(&am.Measurement{
+		Name: "req", Type: am.Timer, Value: 10, SampleRate: 1,
+		Tags: am.Tags{{Key: "route", Value: "/users"}},
+	})
+
+	payload := newHerokuPayload(set, nil)
+
+	if _, ok := payload.Counters["req.route__users.count"]; !ok {
+		t.Errorf("missing req.route__users.count in %v", payload.Counters)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agentmon
+
+import (
+	"math"
+	"sort"
+)
+
+// sketchRelativeAccuracy is the relative error guaranteed by every
+// Sketch. It is fixed so that all Sketches can be merged.
+const sketchRelativeAccuracy = 0.01
+
+var (
+	sketchGamma    = (1 + sketchRelativeAccuracy) / (1 - sketchRelativeAccuracy)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+// Sketch is a mergeable quantile sketch in the style of DDSketch. Values
+// are counted in logarithmically sized buckets, such that any quantile
+// returned is within 1% of the true value.
+type Sketch struct {
+	positive map[int]float64
+	negative map[int]float64
+	zero     float64
+	count    float64
+	min      float64
+	max      float64
+}
+
+// NewSketch constructs an empty Sketch.
+func NewSketch() *Sketch {
+	return &Sketch{
+		positive: make(map[int]float64),
+		negative: make(map[int]float64),
+	}
+}
+
+// Add records value in the Sketch with the given weight. For a
+// Measurement, weight is expected to be the inverse of its SampleRate.
+func (s *Sketch) Add(value, weight float64) {
+	if s.count == 0 || value < s.min {
+		s.min = value
+	}
+	if s.count == 0 || value > s.max {
+		s.max = value
+	}
+	s.count += weight
+
+	switch {
+	case value > 0:
+		s.positive[sketchIndex(value)] += weight
+	case value < 0:
+		s.negative[sketchIndex(-value)] += weight
+	default:
+		s.zero += weight
+	}
+}
+
+// Count returns the total weight of values added to the Sketch.
+func (s *Sketch) Count() float64 {
+	return s.count
+}
+
+// Quantile returns an estimate of the value at quantile q, where q is
+// between 0 and 1. An empty Sketch returns 0.
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return s.min
+	}
+	if q >= 1 {
+		return s.max
+	}
+
+	rank := q * s.count
+	var seen float64
+
+	// Negative values are visited from the largest magnitude down.
+	for _, i := range sortedIndexes(s.negative, true) {
+		seen += s.negative[i]
+		if seen >= rank {
+			return s.clamp(-sketchValue(i))
+		}
+	}
+
+	seen += s.zero
+	if seen >= rank {
+		return 0
+	}
+
+	for _, i := range sortedIndexes(s.positive, false) {
+		seen += s.positive[i]
+		if seen >= rank {
+			return s.clamp(sketchValue(i))
+		}
+	}
+
+	return s.max
+}
+
+// Merge adds all of the values recorded in other to the Sketch.
+func (s *Sketch) Merge(other *Sketch) {
+	if other == nil || other.count == 0 {
+		return
+	}
+	if s.count == 0 || other.min < s.min {
+		s.min = other.min
+	}
+	if s.count == 0 || other.max > s.max {
+		s.max = other.max
+	}
+	s.count += other.count
+	s.zero += other.zero
+	for k, v := range other.positive {
+		s.positive[k] += v
+	}
+	for k, v := range other.negative {
+		s.negative[k] += v
+	}
+}
+
+// Snapshot returns a copy of the Sketch.
+func (s *Sketch) Snapshot() *Sketch {
+	out := NewSketch()
+	out.Merge(s)
+	return out
+}
+
+// clamp keeps bucket estimates within the observed range of values.
+func (s *Sketch) clamp(v float64) float64 {
+	return math.Max(s.min, math.Min(s.max, v))
+}
+
+// sketchIndex returns the bucket for a positive value.
+func sketchIndex(v float64) int {
+	return int(math.Ceil(math.Log(v) / sketchLogGamma))
+}
+
+// sketchValue returns the representative value of bucket i, which is
+// within sketchRelativeAccuracy of every value mapped to it.
+func sketchValue(i int) float64 {
+	return 2 * math.Pow(sketchGamma, float64(i)) / (1 + sketchGamma)
+}
+
+func sortedIndexes(buckets map[int]float64, reverse bool) []int {
+	out := make([]int, 0, len(buckets))
+	for k := range buckets {
+		out = append(out, k)
+	}
+	if reverse {
+		sort.Sort(sort.Reverse(sort.IntSlice(out)))
+	} else {
+		sort.Ints(out)
+	}
+	return out
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agentmon
+
+import (
+	"math"
+	"testing"
+)
+
+func within(got, want, tolerance float64) bool {
+	if want == 0 {
+		return got == 0
+	}
+	return math.Abs((got-want)/want) <= tolerance
+}
+
+func TestSketchQuantiles(t *testing.T) {
+	s := NewSketch()
+	for i := 1; i <= 1000; i++ {
+		s.Add(float64(i), 1)
+	}
+
+	if s.Count() != 1000 {
+		t.Errorf("got count %f, want 1000", s.Count())
+	}
+
+	for q, want := range map[float64]float64{
+		0:     1,
+		0.5:   500,
+		0.95:  950,
+		0.99:  990,
+		0.999: 999,
+		1:     1000,
+	} {
+		if got := s.Quantile(q); !within(got, want, sketchRelativeAccuracy) {
+			t.Errorf("q%v: got %f, want %f", q, got, want)
+		}
+	}
+}
+
+func TestSketchNegativeAndZero(t *testing.T) {
+	s := NewSketch()
+	for _, v := range []float64{-100, -10, 0, 0, 10, 100} {
+		s.Add(v, 1)
+	}
+
+	for q, want := range map[float64]float64{
+		0.1: -100,
+		0.3: -10,
+		0.5: 0,
+		0.8: 10,
+		0.9: 100,
+	} {
+		if got := s.Quantile(q); !within(got, want, sketchRelativeAccuracy) {
+			t.Errorf("q%v: got %f, want %f", q, got, want)
+		}
+	}
+}
+
+func TestSketchWeights(t *testing.T) {
+	s := NewSketch()
+	s.Add(1, 1)
+	s.Add(100, 9)
+
+	if got := s.Quantile(0.5); !within(got, 100, sketchRelativeAccuracy) {
+		t.Errorf("got %f, want 100", got)
+	}
+}
+
+func TestSketchMerge(t *testing.T) {
+	a, b := NewSketch(), NewSketch()
+	for i := 1; i <= 500; i++ {
+		a.Add(float64(i), 1)
+	}
+	for i := 501; i <= 1000; i++ {
+		b.Add(float64(i), 1)
+	}
+
+	a.Merge(b)
+
+	if a.Count() != 1000 {
+		t.Errorf("got count %f, want 1000", a.Count())
+	}
+	if got := a.Quantile(0.99); !within(got, 990, sketchRelativeAccuracy) {
+		t.Errorf("got %f, want 990", got)
+	}
+	if got := a.Quantile(0); got != 1 {
+		t.Errorf("got min %f, want 1", got)
+	}
+}
+
+func TestSketchSnapshot(t *testing.T) {
+	s := NewSketch()
+	s.Add(1, 1)
+
+	snap := s.Snapshot()
+	s.Add(1000, 100)
+
+	if snap.Count() != 1 {
+		t.Errorf("snapshot should not reflect updates to the original: count = %f", snap.Count())
+	}
+	if got := snap.Quantile(1); got != 1 {
+		t.Errorf("got max %f, want 1", got)
+	}
+}
+
+func TestSketchEmpty(t *testing.T) {
+	if got := NewSketch().Quantile(0.99); got != 0 {
+		t.Errorf("got %f, want 0", got)
+	}
+}
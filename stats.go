@@ -0,0 +1,157 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agentmon
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Stats holds counters about agentmon itself, such as how many
+// measurements were dropped, so they can be reported like any other
+// metric. A nil *Stats is valid, and counts nothing.
+type Stats struct {
+	mu       sync.Mutex
+	counters map[string]*StatCounter
+	gauges   map[string]statGauge
+}
+
+// statGauge is a gauge within Stats, whose value is read on Collect.
+type statGauge struct {
+	series Series
+	fn     func() float64
+}
+
+// StatCounter is a counter within Stats. It's safe for concurrent use,
+// and a nil *StatCounter ignores whatever is added to it.
+type StatCounter struct {
+	series Series
+	n      uint64
+	last   uint64
+}
+
+// NewStats constructs an empty Stats.
+func NewStats() *Stats {
+	return &Stats{
+		counters: make(map[string]*StatCounter),
+		gauges:   make(map[string]statGauge),
+	}
+}
+
+// Counter returns the counter for name and tags, creating it if
+// necessary.
+func (s *Stats) Counter(name string, tags ...Tag) *StatCounter {
+	if s == nil {
+		return nil
+	}
+
+	series := Series{Name: name, Tags: Tags(tags).Sorted()}
+	key := series.Key()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.counters[key]
+	if !ok {
+		c = &StatCounter{series: series}
+		s.counters[key] = c
+	}
+	return c
+}
+
+// GaugeFunc registers a gauge for name and tags, whose value is read
+// from fn on every Collect. It replaces any gauge of the same series.
+func (s *Stats) GaugeFunc(name string, fn func() float64, tags ...Tag) {
+	if s == nil {
+		return
+	}
+
+	series := Series{Name: name, Tags: Tags(tags).Sorted()}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gauges[series.Key()] = statGauge{series: series, fn: fn}
+}
+
+// Add increments the counter by n.
+func (c *StatCounter) Add(n uint64) {
+	if c == nil {
+		return
+	}
+	atomic.AddUint64(&c.n, n)
+}
+
+// Value returns the counter's total.
+func (c *StatCounter) Value() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.n)
+}
+
+// Collect returns a Counter Measurement for each counter that has
+// grown since the last Collect, valued at how much it grew, and a Gauge
+// Measurement for each gauge.
+func (s *Stats) Collect() []*Measurement {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []*Measurement
+	for _, c := range s.counters {
+		n := atomic.LoadUint64(&c.n)
+		if n == c.last {
+			continue
+		}
+
+		out = append(out, &Measurement{
+			Name:       c.series.Name,
+			Tags:       c.series.Tags,
+			Type:       Counter,
+			Value:      float64(n - c.last),
+			SampleRate: 1,
+		})
+		c.last = n
+	}
+
+	for _, g := range s.gauges {
+		out = append(out, &Measurement{
+			Name:       g.series.Name,
+			Tags:       g.series.Tags,
+			Type:       Gauge,
+			Value:      g.fn(),
+			SampleRate: 1,
+		})
+	}
+	return out
+}
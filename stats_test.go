@@ -0,0 +1,94 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agentmon
+
+import "testing"
+
+func TestStatsCollect(t *testing.T) {
+	stats := NewStats()
+	a := stats.Counter("agentmon.test", Tag{Key: "source", Value: "a"})
+	b := stats.Counter("agentmon.test", Tag{Key: "source", Value: "b"})
+
+	if stats.Counter("agentmon.test", Tag{Key: "source", Value: "a"}) != a {
+		t.Fatal("expected the same counter for the same series")
+	}
+
+	a.Add(3)
+	ms := stats.Collect()
+	if len(ms) != 1 {
+		t.Fatalf("got %d measurements, want 1", len(ms))
+	}
+	if ms[0].Type != Counter || ms[0].Value != 3 || ms[0].Tags[0].Value != "a" {
+		t.Errorf("unexpected measurement %+v", ms[0])
+	}
+
+	// Only growth since the last Collect is reported.
+	a.Add(1)
+	b.Add(2)
+	set := NewMetricSet(nil)
+	for _, m := range stats.Collect() {
+		set.Update(m)
+	}
+	for series, want := range map[string]float64{"a": 1, "b": 2} {
+		key := Series{Name: "agentmon.test", Tags: Tags{{Key: "source", Value: series}}}.Key()
+		if got := set.Counters[key]; got != want {
+			t.Errorf("got %s=%f, want %f", series, got, want)
+		}
+	}
+
+	if ms := stats.Collect(); len(ms) != 0 {
+		t.Errorf("got %d measurements, want none", len(ms))
+	}
+}
+
+func TestStatsGaugeFunc(t *testing.T) {
+	stats := NewStats()
+	depth := 3.0
+	stats.GaugeFunc("agentmon.test", func() float64 { return depth })
+
+	for _, want := range []float64{3, 5} {
+		depth = want
+		ms := stats.Collect()
+		if len(ms) != 1 || ms[0].Type != Gauge || ms[0].Value != want {
+			t.Errorf("got %+v, want a gauge of %f", ms, want)
+		}
+	}
+}
+
+func TestStatsNil(t *testing.T) {
+	var stats *Stats
+	c := stats.Counter("agentmon.test")
+	c.Add(1)
+	stats.GaugeFunc("agentmon.test", func() float64 { return 1 })
+	if c.Value() != 0 || stats.Collect() != nil {
+		t.Error("expected a nil Stats to count nothing")
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package statsd
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/heroku/agentmon"
+)
+
+// MalformedMetricName is the name of the counter of lines that failed to
+// parse, tagged by the kind of ParseError.
+const MalformedMetricName = "agentmon.statsd.malformed"
+
+// ParseErrorKind classifies why a line failed to parse.
+type ParseErrorKind int
+
+const (
+	// Malformed lines are missing a separator, have unexpected
+	// sections, or are events or service checks that don't parse.
+	Malformed ParseErrorKind = iota
+	// BadName lines don't start with a valid metric name.
+	BadName
+	// BadValue lines have a value that isn't valid for its type.
+	BadValue
+	// UnknownType lines have a type other than c, g, ms, s, h, or d.
+	UnknownType
+	// BadSampleRate lines have a sample rate that isn't a number
+	// greater than 0, and at most 1.
+	BadSampleRate
+	// BadTimestamp lines have a timestamp that isn't a unix time.
+	BadTimestamp
+
+	numParseErrorKinds
+)
+
+func (k ParseErrorKind) String() string {
+	switch k {
+	case BadName:
+		return "bad-name"
+	case BadValue:
+		return "bad-value"
+	case UnknownType:
+		return "unknown-type"
+	case BadSampleRate:
+		return "bad-sample-rate"
+	case BadTimestamp:
+		return "bad-timestamp"
+	default:
+		return "malformed"
+	}
+}
+
+// ParseError is returned for a line that failed to parse.
+type ParseError struct {
+	Kind ParseErrorKind
+	Line string
+	Err  error
+}
+
+func parseError(kind ParseErrorKind, format string, args ...interface{}) *ParseError {
+	return &ParseError{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// parseErrors counts the lines that fail to parse, by kind, and, if
+// interval is positive, logs at most one of them per interval. It's
+// shared by all of a Listener's Parsers, and a nil *parseErrors does
+// nothing.
+type parseErrors struct {
+	counters   [numParseErrorKinds]*agentmon.StatCounter
+	interval   time.Duration
+	last       int64 // UnixNano of the last line logged
+	suppressed uint64
+}
+
+func newParseErrors(stats *agentmon.Stats, interval time.Duration) *parseErrors {
+	e := &parseErrors{interval: interval}
+	for k := range e.counters {
+		e.counters[k] = stats.Counter(MalformedMetricName,
+			agentmon.Tag{Key: "kind", Value: ParseErrorKind(k).String()})
+	}
+	return e
+}
+
+func (e *parseErrors) record(err *ParseError) {
+	if e == nil {
+		return
+	}
+	e.counters[err.Kind].Add(1)
+
+	if e.interval <= 0 {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&e.last)
+	if now-last < int64(e.interval) || !atomic.CompareAndSwapInt64(&e.last, last, now) {
+		atomic.AddUint64(&e.suppressed, 1)
+		return
+	}
+
+	if n := atomic.SwapUint64(&e.suppressed, 0); n > 0 {
+		log.Printf("statsd: %s in %q (and %d more since)", err, err.Line, n)
+	} else {
+		log.Printf("statsd: %s in %q", err, err.Line)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package statsd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	am "github.com/heroku/agentmon"
+)
+
+func TestParseErrorKinds(t *testing.T) {
+	for input, kind := range map[string]ParseErrorKind{
+		"gorets":          Malformed,
+		"gorets:1":        Malformed,
+		"gorets:1|c|x":    Malformed,
+		"_e{5,4}:title|t": Malformed,
+		"!orets:1|c":      BadName,
+		"gorets:abc|c":    BadValue,
+		"gorets:|s":       BadValue,
+		"gorets:1|z":      UnknownType,
+		"gorets:1|c|@":    BadSampleRate,
+		"gorets:1|c|@x":   BadSampleRate,
+		"gorets:1|c|@0":   BadSampleRate,
+		"gorets:1|c|@-1":  BadSampleRate,
+		"gorets:1|c|@2":   BadSampleRate,
+		"gorets:1|c|T":    BadTimestamp,
+		"gorets:1|c|Tx":   BadTimestamp,
+	} {
+		parser := &Parser{}
+		_, err := parser.parseLine([]byte(input))
+
+		var pe *ParseError
+		if !errors.As(err, &pe) {
+			t.Errorf("Expected a *ParseError for %q, got %v", input, err)
+			continue
+		}
+		if pe.Kind != kind {
+			t.Errorf("Expected kind=%s for %q, got %s (%s)", kind, input, pe.Kind, pe)
+		}
+		if pe.Line != input {
+			t.Errorf("Expected line=%q, got %q", input, pe.Line)
+		}
+	}
+}
+
+func TestParserSkipsErrors(t *testing.T) {
+	parser := NewParser(strings.NewReader("aa:1|c\nbb:x|c\ncc:1|c\n"), false, 1024)
+
+	ms, errs := parseAll(parser)
+	var names []string
+	for _, m := range ms {
+		names = append(names, m.Name)
+	}
+	var kinds []ParseErrorKind
+	for _, err := range errs {
+		var pe *ParseError
+		if errors.As(err, &pe) {
+			kinds = append(kinds, pe.Kind)
+		}
+	}
+
+	if strings.Join(names, ",") != "aa,cc" {
+		t.Errorf("Expected aa,cc around the bad line, got %v", names)
+	}
+	if len(kinds) != 1 || kinds[0] != BadValue {
+		t.Errorf("Expected a single bad-value error, got %v", kinds)
+	}
+}
+
+func TestParseErrorsCounted(t *testing.T) {
+	stats := am.NewStats()
+	parser := &Parser{errors: newParseErrors(stats, time.Hour)}
+
+	for _, line := range []string{"aa:x|c", "aa:y|c", "aa:1|z", "aa:1|c"} {
+		parser.parsePacket([]byte(line), func(*am.Measurement) {})
+	}
+
+	counted := map[string]float64{}
+	for _, m := range stats.Collect() {
+		if m.Name != MalformedMetricName {
+			t.Errorf("Unexpected stat %s", m.Name)
+			continue
+		}
+		counted[m.Tags[0].Value] = m.Value
+	}
+	if counted["bad-value"] != 2 || counted["unknown-type"] != 1 || len(counted) != 2 {
+		t.Errorf("Expected 2 bad-value, and 1 unknown-type, got %v", counted)
+	}
+	if n := parser.errors.suppressed; n != 2 {
+		t.Errorf("Expected 2 lines to be left unlogged, got %d", n)
+	}
+}
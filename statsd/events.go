@@ -0,0 +1,253 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package statsd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heroku/agentmon"
+)
+
+const (
+	// EventsMetricName is the counter incremented for every DogStatsD
+	// event received, tagged with the event's alert type, and tags.
+	EventsMetricName = "agentmon.statsd.events"
+
+	defaultEventAlertType = "info"
+)
+
+// Event is a DogStatsD event, such as a deploy notification.
+type Event struct {
+	Title          string
+	Text           string
+	Timestamp      time.Time
+	Hostname       string
+	AggregationKey string
+	Priority       string
+	SourceType     string
+	AlertType      string
+	Tags           agentmon.Tags
+}
+
+// EventSink receives the DogStatsD events observed by a Parser.
+type EventSink interface {
+	HandleEvent(e *Event)
+}
+
+// EventSinkFunc adapts an ordinary function to an EventSink.
+type EventSinkFunc func(e *Event)
+
+// HandleEvent calls f(e).
+func (f EventSinkFunc) HandleEvent(e *Event) {
+	f(e)
+}
+
+// LogEvents is an EventSink that logs each event.
+var LogEvents = EventSinkFunc(func(e *Event) {
+	log.Printf("event: [%s] %s: %q tags=%v", e.AlertType, e.Title, e.Text, e.Tags)
+})
+
+// ServiceCheck statuses, as reported in a DogStatsD service check.
+const (
+	ServiceCheckOK = iota
+	ServiceCheckWarning
+	ServiceCheckCritical
+	ServiceCheckUnknown
+)
+
+// parseEvent parses a DogStatsD event of the form:
+//
+//	_e{title.length,text.length}:title|text|d:timestamp|h:hostname|p:priority|t:alert_type|#tags
+//
+// The event is handed to the Parser's Events sink, if any, and a
+// counter is returned in its place.
+func (p *Parser) parseEvent(line []byte) (*agentmon.Measurement, error) {
+	rest, _ := expect(line, []byte("_e{"))
+
+	titleLen, rest, err := readLength(rest, ',')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read event title length from %q: %s", string(line), err)
+	}
+	textLen, rest, err := readLength(rest, '}')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read event text length from %q: %s", string(line), err)
+	}
+
+	rest, ok := expect(rest, []byte(":"))
+	if !ok || titleLen == 0 || len(rest) < titleLen+1+textLen {
+		return nil, fmt.Errorf("malformed event %q", string(line))
+	}
+
+	e := &Event{
+		Title:     string(rest[:titleLen]),
+		Text:      strings.Replace(string(rest[titleLen+1:titleLen+1+textLen]), `\n`, "\n", -1),
+		Timestamp: time.Now(),
+		Priority:  "normal",
+		AlertType: defaultEventAlertType,
+	}
+	if rest[titleLen] != '|' {
+		return nil, fmt.Errorf("expected '|' after event title in %q", string(line))
+	}
+	rest = rest[titleLen+1+textLen:]
+
+	for len(rest) > 0 {
+		var section []byte
+		if rest, ok = expect(rest, []byte("|")); !ok {
+			return nil, fmt.Errorf("malformed event %q", string(line))
+		}
+		if bytes.HasPrefix(rest, []byte("#")) {
+			e.Tags, rest = readTags(rest[1:], e.Tags)
+			continue
+		}
+
+		section, rest = readRawValue(rest)
+		if len(section) < 2 || section[1] != ':' {
+			return nil, fmt.Errorf("unexpected event section %q", string(section))
+		}
+		value := string(section[2:])
+
+		switch section[0] {
+		case 'd':
+			if e.Timestamp, err = parseTimestamp(value); err != nil {
+				return nil, err
+			}
+		case 'h':
+			e.Hostname = value
+		case 'k':
+			e.AggregationKey = value
+		case 'p':
+			e.Priority = value
+		case 's':
+			e.SourceType = value
+		case 't':
+			e.AlertType = value
+		default:
+			return nil, fmt.Errorf("unexpected event section %q", string(section))
+		}
+	}
+
+	if p.Events != nil {
+		p.Events.HandleEvent(e)
+	}
+
+	tags := append(agentmon.Tags{{Key: "alert_type", Value: e.AlertType}}, e.Tags...)
+	return &agentmon.Measurement{
+		Name:       EventsMetricName,
+		Timestamp:  e.Timestamp,
+		Type:       agentmon.Counter,
+		Value:      1,
+		SampleRate: 1.0,
+		Tags:       tags,
+	}, nil
+}
+
+// parseServiceCheck parses a DogStatsD service check of the form:
+//
+//	_sc|name|status|d:timestamp|h:hostname|#tags|m:message
+//
+// It's returned as a gauge named after the check, with the status
+// (0-3) as its value.
+func parseServiceCheck(line []byte) (*agentmon.Measurement, error) {
+	rest, _ := expect(line, []byte("_sc|"))
+
+	name, rest, err := readMetricName(rest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read a service check name from %q: %s", string(line), err)
+	}
+
+	rest, ok := expect(rest, []byte("|"))
+	if !ok || len(rest) == 0 || rest[0] < '0' || rest[0] > '3' || (len(rest) > 1 && rest[1] != '|') {
+		return nil, fmt.Errorf("invalid service check status in %q", string(line))
+	}
+
+	out := &agentmon.Measurement{
+		Name:       string(name),
+		Timestamp:  time.Now(),
+		Type:       agentmon.Gauge,
+		Value:      float64(rest[0] - '0'),
+		SampleRate: 1.0,
+	}
+	rest = rest[1:]
+
+	for len(rest) > 0 {
+		var section []byte
+		if rest, ok = expect(rest, []byte("|")); !ok {
+			return nil, fmt.Errorf("malformed service check %q", string(line))
+		}
+
+		switch {
+		case bytes.HasPrefix(rest, []byte("#")):
+			out.Tags, rest = readTags(rest[1:], out.Tags)
+		case bytes.HasPrefix(rest, []byte("m:")):
+			// The message is always last, and may contain '|'.
+			rest = nil
+		case bytes.HasPrefix(rest, []byte("d:")):
+			section, rest = readRawValue(rest[2:])
+			if out.Timestamp, err = parseTimestamp(string(section)); err != nil {
+				return nil, err
+			}
+		case bytes.HasPrefix(rest, []byte("h:")):
+			_, rest = readRawValue(rest[2:])
+		default:
+			return nil, fmt.Errorf("unexpected service check section %q", string(rest))
+		}
+	}
+
+	return out, nil
+}
+
+// readLength reads a decimal length terminated by term.
+func readLength(buf []byte, term byte) (int, []byte, error) {
+	i := bytes.IndexByte(buf, term)
+	if i <= 0 {
+		return 0, buf, errors.New("missing length")
+	}
+	n, err := strconv.Atoi(string(buf[:i]))
+	if err != nil || n < 0 {
+		return 0, buf, fmt.Errorf("invalid length %q", string(buf[:i]))
+	}
+	return n, buf[i+1:], nil
+}
+
+// parseTimestamp parses a unix timestamp, in seconds.
+func parseTimestamp(s string) (time.Time, error) {
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return time.Unix(secs, 0), nil
+}
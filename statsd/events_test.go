@@ -0,0 +1,157 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package statsd
+
+import (
+	"testing"
+	"time"
+
+	am "github.com/heroku/agentmon"
+)
+
+func TestParseEvent(t *testing.T) {
+	var got *Event
+	parser := &Parser{Events: EventSinkFunc(func(e *Event) { got = e })}
+
+	ms, err := parser.parseLine([]byte(`_e{8,20}:Deployed|v123 by alice\nfixes|d:1500000000|h:web.1|p:low|t:success|k:deploy|s:git|#env:prod,app:api`))
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+
+	if len(ms) != 1 {
+		t.Fatalf("Expected 1 measurement, got %d", len(ms))
+	}
+	m := ms[0]
+
+	if got == nil {
+		t.Fatalf("Expected the event to be sent to the sink")
+	}
+	want := Event{
+		Title:          "Deployed",
+		Text:           "v123 by alice\nfixes",
+		Timestamp:      time.Unix(1500000000, 0),
+		Hostname:       "web.1",
+		AggregationKey: "deploy",
+		Priority:       "low",
+		SourceType:     "git",
+		AlertType:      "success",
+	}
+	if got.Title != want.Title || got.Text != want.Text || !got.Timestamp.Equal(want.Timestamp) ||
+		got.Hostname != want.Hostname || got.AggregationKey != want.AggregationKey ||
+		got.Priority != want.Priority || got.SourceType != want.SourceType || got.AlertType != want.AlertType {
+		t.Errorf("Expected event=%+v, got %+v", want, *got)
+	}
+	if len(got.Tags) != 2 {
+		t.Errorf("Expected 2 tags, got %v", got.Tags)
+	}
+
+	exp := &am.Measurement{
+		Name: EventsMetricName,
+		Type: am.Counter,
+		Tags: am.Tags{
+			{Key: "alert_type", Value: "success"},
+			{Key: "env", Value: "prod"},
+			{Key: "app", Value: "api"},
+		},
+	}
+	if m.Series().Key() != exp.Series().Key() {
+		t.Errorf("Expected series=%v, got %v", exp.Series(), m.Series())
+	}
+	if m.Type != am.Counter || m.Value != 1 {
+		t.Errorf("Expected a counter of 1, got %+v", m)
+	}
+}
+
+func TestParseEventWithoutSink(t *testing.T) {
+	parser := &Parser{}
+	ms, err := parser.parseLine([]byte(`_e{5,4}:title|te|x`))
+	if err != nil {
+		t.Fatalf("Got unexpected error: %s", err)
+	}
+	m := ms[0]
+
+	exp := am.Series{Name: EventsMetricName, Tags: am.Tags{{Key: "alert_type", Value: "info"}}}
+	if m.Series().Key() != exp.Key() {
+		t.Errorf("Expected series=%v, got %v", exp, m.Series())
+	}
+}
+
+func TestParseServiceCheck(t *testing.T) {
+	for input, exp := range map[string]*am.Measurement{
+		"_sc|app.can_connect|0": &am.Measurement{
+			Name:  "app.can_connect",
+			Value: ServiceCheckOK,
+		},
+		"_sc|app.can_connect|2|d:1500000000|h:web.1|#env:prod|m:timed out | retrying": &am.Measurement{
+			Name:  "app.can_connect",
+			Value: ServiceCheckCritical,
+			Tags:  am.Tags{{Key: "env", Value: "prod"}},
+		},
+	} {
+		parser := &Parser{}
+		ms, err := parser.parseLine([]byte(input))
+		if err != nil {
+			t.Errorf("Got unexpected error for %q: %s", input, err)
+			continue
+		}
+		out := ms[0]
+
+		if out.Series().Key() != exp.Series().Key() {
+			t.Errorf("Expected series=%v, got %v", exp.Series(), out.Series())
+		}
+		if out.Value != exp.Value {
+			t.Errorf("Expected value=%f, got %f", exp.Value, out.Value)
+		}
+		if out.Type != am.Gauge {
+			t.Errorf("Expected type=%v, got %v", am.Gauge, out.Type)
+		}
+	}
+}
+
+func TestParseEventAndServiceCheckErrors(t *testing.T) {
+	for _, input := range []string{
+		"_e{5,4}:title",
+		"_e{5,4}:titletext",
+		"_e{x,4}:title|text",
+		"_e{0,4}:|text",
+		"_e{5,4}:title|text|z:1",
+		"_e{5,4}:title|text|d:abc",
+		"_sc|app.check",
+		"_sc|app.check|4",
+		"_sc|app.check|01",
+		"_sc|app.check|0|x:1",
+	} {
+		parser := &Parser{}
+		if out, err := parser.parseLine([]byte(input)); err == nil {
+			t.Errorf("Expected an error for %q, got %+v", input, out)
+		}
+	}
+}
@@ -35,78 +35,218 @@ package statsd
 
 import (
 	"context"
-	"io"
 	"log"
 	"net"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/heroku/agentmon"
+	"github.com/heroku/agentmon/internal/netutil"
 )
 
 const (
-	defaultMaxPacketSizeUDP = 1472
+	defaultMaxPacketSizeUDP      = 1472
+	defaultMaxPacketSizeUnixgram = 8192
+	maxPacketSizeUDP             = 65535
+	defaultBatchSizeUDP          = 32
+	defaultReadSizeTCP           = 4096
+	defaultMaxLineLength         = 64 * 1024
+	defaultIdleTimeout           = 5 * time.Minute
 )
 
 // Listener defines the parameters needed to accept statsd protocol
-// UDP packets.
+// UDP packets, TCP streams, or either over a Unix domain socket.
 type Listener struct {
 	// MaxPacketSize is the maximum amount of bytes that will be read per incoming statsd datagram.
+	// Defaults to 1472 for UDP, and 8192, as DogStatsD clients send, for
+	// Unix datagrams.
 	MaxPacketSize int64
 
-	// Addr is the address to be used for listening for UDP datagrams.
+	// Readers is the number of UDP sockets, each with its own goroutine,
+	// bound to Addr with SO_REUSEPORT. Only Linux supports more than one.
+	Readers int
+
+	// ReceiveBuffer, if set, is the size in bytes requested for each UDP
+	// socket's receive buffer.
+	ReceiveBuffer int
+
+	// BatchSize is the most datagrams read by a single system call on
+	// Linux. Defaults to 32.
+	BatchSize int
+
+	// Addr is the address to be used for listening for UDP datagrams,
+	// or TCP connections, or the path of a Unix socket.
 	Addr string
 
-	PartialReads bool
+	// MaxLineLength is the longest line accepted over TCP. Longer lines
+	// are discarded. Defaults to 64KiB.
+	MaxLineLength int
+
+	// IdleTimeout is how long a TCP connection may go without sending
+	// anything before it's closed. Defaults to 5 minutes.
+	IdleTimeout time.Duration
+
+	// SocketMode, if set, is the file mode given to Unix sockets.
+	SocketMode os.FileMode
+
+	// SocketOwner and SocketGroup, if set, are the names of the user
+	// and group that Unix sockets are changed to be owned by.
+	SocketOwner string
+	SocketGroup string
+
+	// OriginDetection, on Linux, tags measurements received over a Unix
+	// socket with the `pid` and `process` name of the sender.
+	OriginDetection bool
+
+	// Inbox is the channel to use to observe Batches of incoming
+	// measurements.
+	Inbox chan *agentmon.Batch
+
+	// Backpressure is what's done with measurements that don't fit in
+	// the Inbox. Defaults to agentmon.Block.
+	Backpressure agentmon.Backpressure
+
+	// Transform, if set, rewrites each measurement, e.g. with name
+	// Templates, before it's sent to the Inbox.
+	Transform agentmon.Transformer
+
+	// Stats, if set, counts the measurements dropped due to
+	// Backpressure, and the lines that fail to parse.
+	Stats *agentmon.Stats
 
-	// Inbox is the channel to use to observe incoming measurements
-	Inbox chan *agentmon.Measurement
+	// MalformedLogInterval, if positive, logs at most one line that
+	// failed to parse per interval, as a sample of what's being sent.
+	MalformedLogInterval time.Duration
+
+	// Events, if set, receives DogStatsD events. Events are always
+	// counted via the EventsMetricName counter.
+	Events EventSink
 
 	// Debug is used to turn on extended logging, useful for debugging
 	// purposes.
 	Debug bool
+
+	origins *originCache
+	errors  *parseErrors
 }
 
-// ListenUDP sets
-func (s Listener) ListenUDP(ctx context.Context) {
-	resAddr, err := net.ResolveUDPAddr("udp", s.Addr)
+// ListenTCP accepts TCP connections on Addr, each of which is expected
+// to send newline separated statsd messages. Connections are closed,
+// and ListenTCP returns, once ctx is cancelled.
+func (s Listener) ListenTCP(ctx context.Context) {
+	resAddr, err := net.ResolveTCPAddr("tcp", s.Addr)
 	if err != nil {
-		log.Fatalf("listenUDP: resolve addr: %s", err)
+		log.Fatalf("listenTCP: resolve addr: %s", err)
 	}
 
-	log.Printf("Listening on %s...", resAddr)
-	listener, err := net.ListenUDP("udp", resAddr)
+	log.Printf("Listening on %s (tcp)...", resAddr)
+	listener, err := net.ListenTCP("tcp", resAddr)
 	if err != nil {
-		log.Fatalf("listenUDP: %s", err)
+		log.Fatalf("listenTCP: %s", err)
 	}
 
-	s.parseLoop(ctx, listener)
+	s.serveStream(ctx, listener)
 }
 
-func (s Listener) parseLoop(ctx context.Context, conn io.ReadCloser) {
+func (s Listener) serveStream(ctx context.Context, listener net.Listener) {
+	s.errors = newParseErrors(s.Stats, s.MalformedLogInterval)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				if s.Debug {
+					log.Println("debug: stopping statsd stream listener")
+				}
+				return
+			}
+			log.Printf("serveStream: accept: %s", err)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleConn(ctx, conn)
+		}()
+	}
+}
+
+func (s Listener) handleConn(ctx context.Context, conn net.Conn) {
 	defer conn.Close()
 
-	if s.MaxPacketSize == 0 {
-		s.MaxPacketSize = defaultMaxPacketSizeUDP
+	if s.IdleTimeout == 0 {
+		s.IdleTimeout = defaultIdleTimeout
+	}
+	if s.MaxLineLength == 0 {
+		s.MaxLineLength = defaultMaxLineLength
 	}
 
 	if s.Debug {
-		log.Println("debug: handling incoming statsd packet")
+		log.Printf("debug: handling statsd connection from %s", conn.RemoteAddr())
 	}
 
-	parser := NewParser(conn, s.PartialReads, int(s.MaxPacketSize))
-
-	for {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
 		select {
 		case <-ctx.Done():
-			break
-		default:
-			m, more := parser.Next()
-			if m != nil {
-				s.Inbox <- m
-			}
+			conn.Close()
+		case <-done:
+		}
+	}()
 
-			if !more {
-				break
-			}
+	var origin agentmon.Tags
+	if s.origins != nil {
+		if pid, ok := peerPID(conn); ok {
+			origin = s.origins.tags(pid)
 		}
 	}
+
+	parser := NewParser(&netutil.ConnReader{Conn: conn, Timeout: s.IdleTimeout}, true, defaultReadSizeTCP)
+	parser.Events = s.Events
+	parser.MaxLineLength = s.MaxLineLength
+	parser.errors = s.errors
+	sender := s.newSender()
+
+	ok := true
+	add := func(m *agentmon.Measurement) {
+		ok = ok && sender.Add(ctx, withOrigin(m, origin))
+	}
+
+	for {
+		line, more := parser.nextLine()
+		if len(line) > 0 {
+			parser.scanLine(line, add)
+		}
+		if !ok {
+			return
+		}
+
+		// Send what there is before waiting on the connection.
+		if !parser.buffered() && !sender.Flush(ctx) {
+			return
+		}
+
+		if !more {
+			return
+		}
+	}
+}
+
+// newSender returns a Sender to the Inbox that applies Backpressure,
+// and Transform.
+func (s Listener) newSender() *agentmon.Sender {
+	sender := agentmon.NewSender(s.Inbox, s.Backpressure, s.Stats, "statsd")
+	sender.Transform = s.Transform
+	return sender
 }
@@ -31,99 +31,164 @@
 package statsd
 
 import (
-	"bytes"
 	"context"
-	"errors"
+	"net"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	am "github.com/heroku/agentmon"
+	"github.com/heroku/agentmon/internal/testutil"
 )
 
-type ClosableBuffer struct {
-	*bytes.Buffer
-	closed bool
-}
-
-func (c *ClosableBuffer) Close() error {
-	if c.closed {
-		return errors.New("already closed")
+func startTCP(t *testing.T, listener Listener) (string, context.CancelFunc, *sync.WaitGroup) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
 	}
-	c.closed = true
-	return nil
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		listener.serveStream(ctx, l)
+	}()
+
+	return l.Addr().String(), cancel, &wg
 }
 
-func TestParseLoop(t *testing.T) {
-	buf := bytes.NewBuffer([]byte(`gorets:1|c
-gorets:1|c|@0.1
-gaugor:333|g
-`))
-	input := &ClosableBuffer{buf, false}
-
-	var ei int
-	expected := []*am.Measurement{
-		&am.Measurement{
-			Name:  "gorets",
-			Value: 1.0,
-			Type:  am.Counter,
-		},
-		&am.Measurement{
-			Name:  "gorets",
-			Value: 1.0,
-			Type:  am.Counter,
-		},
-		&am.Measurement{
-			Name:  "gaugor",
-			Value: 333.0,
-			Type:  am.Gauge,
-		},
-	}
+func TestListenTCP(t *testing.T) {
+	batches, inbox := testutil.Inbox(t, 10)
+	addr, cancel, wg := startTCP(t, Listener{Inbox: batches})
+	defer wg.Wait()
+	defer cancel()
 
-	inbox := make(chan *am.Measurement, 3)
-	listener := Listener{MaxPacketSize: 100, PartialReads: true, Inbox: inbox}
+	a, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer a.Close()
+	b, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer b.Close()
 
-	go listener.parseLoop(context.Background(), input)
+	// Lines may be split across writes.
+	a.Write([]byte("gor"))
+	b.Write([]byte("gaugor:333|g\n"))
+	a.Write([]byte("ets:1|c\n"))
 
-loop:
-	for {
+	found := make(map[string]float64)
+	for len(found) < 2 {
 		select {
 		case m := <-inbox:
-			if m.Name != expected[ei].Name {
-				t.Errorf("Expected name=%q got=%q", m.Name, expected[ei].Name)
-			}
-			if m.Value != expected[ei].Value {
-				t.Errorf("Expected value=%f got=%f", m.Value, expected[ei].Value)
-			}
-			if m.Type != expected[ei].Type {
-				t.Errorf("Expected type=%q got=%q", m.Type, expected[ei].Type)
-			}
-			ei++
-		case <-time.After(2 * time.Millisecond):
-			if len(expected) != ei {
-				t.Fatalf("Expected to receive %d measurements, found %d", len(expected), ei)
-			}
-			break loop
+			found[m.Name] = m.Value
+		case <-time.After(time.Second):
+			t.Fatalf("Expected 2 measurements, found %v", found)
 		}
 	}
+
+	if found["gorets"] != 1 || found["gaugor"] != 333 {
+		t.Errorf("Unexpected measurements: %v", found)
+	}
 }
 
-func TestParseLoopCancel(t *testing.T) {
-	buf := bytes.NewBuffer([]byte(`gorets:1|c
-gorets:1|c|@0.1
-gaugor:333|g
-`))
-	input := &ClosableBuffer{buf, false}
-	inbox := make(chan *am.Measurement, 1)
-	listener := Listener{MaxPacketSize: 100, PartialReads: true, Inbox: inbox}
-	ctx, cancel := context.WithCancel(context.Background())
+func TestListenTCPMaxLineLength(t *testing.T) {
+	batches, inbox := testutil.Inbox(t, 10)
+	addr, cancel, wg := startTCP(t, Listener{Inbox: batches, MaxLineLength: 32})
+	defer wg.Wait()
+	defer cancel()
 
-	// Cancel before loop starts
-	cancel()
-	go listener.parseLoop(ctx, input)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte(strings.Repeat("a", 100) + ":1|c\ngorets:1|c\n"))
 
 	select {
 	case m := <-inbox:
-		t.Errorf("Got something %+v, expected nothing", m)
-	case <-time.After(1 * time.Millisecond):
+		if m.Name != "gorets" {
+			t.Errorf("Expected name=%q got=%q", "gorets", m.Name)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a measurement following the overlong line")
+	}
+}
+
+func TestListenTCPIdleTimeout(t *testing.T) {
+	addr, cancel, wg := startTCP(t, Listener{Inbox: make(chan *am.Batch, 10), IdleTimeout: 10 * time.Millisecond})
+	defer wg.Wait()
+	defer cancel()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("Expected the idle connection to be closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("Connection was not closed after the idle timeout")
+	}
+}
+
+func TestListenTCPCancel(t *testing.T) {
+	batches, inbox := testutil.Inbox(t, 10)
+	addr, cancel, wg := startTCP(t, Listener{Inbox: batches})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("gorets:1|c\n"))
+	<-inbox
+
+	cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected listener to stop after cancellation")
+	}
+}
+
+func TestListenTCPBackpressure(t *testing.T) {
+	inbox := make(chan *am.Batch, 1)
+	stats := am.NewStats()
+	addr, cancel, wg := startTCP(t, Listener{Inbox: inbox, Backpressure: am.DropNewest, Stats: stats})
+	defer wg.Wait()
+	defer cancel()
+
+	// Leave no room for anything sent.
+	inbox <- am.NewBatch()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	conn.Write([]byte("first:1|c\nsecond:1|c\nthird:1|c\n"))
+	conn.Close()
+
+	dropped := stats.Counter(am.DroppedMetricName,
+		am.Tag{Key: "source", Value: "statsd"}, am.Tag{Key: "policy", Value: "drop-newest"})
+	for deadline := time.Now().Add(time.Second); dropped.Value() < 3; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 3 dropped, got %d", dropped.Value())
+		}
+		time.Sleep(time.Millisecond)
 	}
 }
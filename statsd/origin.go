@@ -0,0 +1,139 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package statsd
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroku/agentmon"
+)
+
+const originCacheTTL = time.Minute
+
+// originCache maps process IDs to Tags identifying the process. Entries
+// expire, as process IDs are eventually reused.
+type originCache struct {
+	mu      sync.Mutex
+	entries map[int32]originEntry
+}
+
+type originEntry struct {
+	tags    agentmon.Tags
+	expires time.Time
+}
+
+func newOriginCache() *originCache {
+	return &originCache{entries: make(map[int32]originEntry)}
+}
+
+// tags returns the `pid` and `process` tags for pid. The process name
+// is read from /proc/<pid>/comm, and is omitted if it can't be.
+func (c *originCache) tags(pid int32) agentmon.Tags {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[pid]; ok && now.Before(e.expires) {
+		return e.tags
+	}
+
+	tags := agentmon.Tags{{Key: "pid", Value: strconv.Itoa(int(pid))}}
+	if comm, err := os.ReadFile("/proc/" + strconv.Itoa(int(pid)) + "/comm"); err == nil {
+		tags = append(tags, agentmon.Tag{Key: "process", Value: strings.TrimSpace(string(comm))})
+	}
+
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[pid] = originEntry{tags: tags, expires: now.Add(originCacheTTL)}
+	return tags
+}
+
+// withOrigin returns m with origin appended to its Tags.
+func withOrigin(m *agentmon.Measurement, origin agentmon.Tags) *agentmon.Measurement {
+	if len(origin) > 0 {
+		tags := make(agentmon.Tags, 0, len(m.Tags)+len(origin))
+		m.Tags = append(append(tags, m.Tags...), origin...)
+	}
+	return m
+}
+
+// originLoop reads datagrams, along with the credentials of the process
+// that sent each of them, from conn, tagging the measurements in each
+// with the sender's origin.
+func (s Listener) originLoop(ctx context.Context, conn *net.UnixConn) {
+	defer conn.Close()
+
+	if s.MaxPacketSize <= 0 {
+		s.MaxPacketSize = defaultMaxPacketSizeUnixgram
+	}
+
+	if err := enableCredentials(conn); err != nil {
+		log.Fatalf("originLoop: %s", err)
+	}
+
+	buf := make([]byte, s.MaxPacketSize)
+	oob := make([]byte, credentialsBufferSize)
+	parser := &Parser{Events: s.Events, errors: s.errors}
+	sender := s.newSender()
+
+	for {
+		n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("originLoop: read: %s", err)
+			continue
+		}
+
+		var origin agentmon.Tags
+		if pid, ok := credentialsPID(oob[:oobn]); ok {
+			origin = s.origins.tags(pid)
+		}
+
+		parser.parsePacket(buf[:n], func(m *agentmon.Measurement) {
+			sender.Add(ctx, withOrigin(m, origin))
+		})
+		sender.Flush(ctx)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build linux
+
+package statsd
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	am "github.com/heroku/agentmon"
+	"github.com/heroku/agentmon/internal/testutil"
+)
+
+func expectOrigin(t *testing.T, inbox chan *am.Measurement) {
+	comm, err := os.ReadFile("/proc/self/comm")
+	if err != nil {
+		t.Fatalf("read comm: %s", err)
+	}
+
+	exp := am.Series{Name: "gorets", Tags: am.Tags{
+		{Key: "env", Value: "test"},
+		{Key: "pid", Value: strconv.Itoa(os.Getpid())},
+		{Key: "process", Value: strings.TrimSpace(string(comm))},
+	}}
+
+	select {
+	case m := <-inbox:
+		if m.Series().Key() != exp.Key() {
+			t.Errorf("Expected series=%v got=%v", exp, m.Series())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a measurement")
+	}
+}
+
+func TestOriginDetectionUnixgram(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "statsd.sock")
+	batches, inbox := testutil.Inbox(t, 10)
+	listener := Listener{Addr: path, Inbox: batches, OriginDetection: true}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go listener.ListenUnixgram(ctx)
+	waitForFile(t, path, true)
+
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("gorets:1|c|#env:test"))
+
+	expectOrigin(t, inbox)
+}
+
+func TestOriginDetectionUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "statsd.sock")
+	batches, inbox := testutil.Inbox(t, 10)
+	listener := Listener{Addr: path, Inbox: batches, OriginDetection: true}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go listener.ListenUnix(ctx)
+	waitForFile(t, path, true)
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("gorets:1|c|#env:test\n"))
+
+	expectOrigin(t, inbox)
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package statsd
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	am "github.com/heroku/agentmon"
+)
+
+func TestOriginCacheTags(t *testing.T) {
+	cache := newOriginCache()
+	pid := int32(os.Getpid())
+
+	tags := cache.tags(pid)
+	if len(tags) == 0 || tags[0] != (am.Tag{Key: "pid", Value: strconv.Itoa(os.Getpid())}) {
+		t.Errorf("Expected a pid tag, got %v", tags)
+	}
+
+	if again := cache.tags(pid); len(again) != len(tags) {
+		t.Errorf("Expected cached tags %v, got %v", tags, again)
+	}
+}
+
+func TestWithOrigin(t *testing.T) {
+	shared := am.Tags{{Key: "env", Value: "prod"}}
+	m := &am.Measurement{Name: "gorets", Tags: shared[:1:1]}
+	origin := am.Tags{{Key: "pid", Value: "1"}}
+
+	withOrigin(m, origin)
+
+	if len(m.Tags) != 2 || m.Tags[1] != origin[0] {
+		t.Errorf("Expected origin tags to be appended, got %v", m.Tags)
+	}
+	if len(shared) != 1 {
+		t.Errorf("Expected original tags to be left alone, got %v", shared)
+	}
+
+	untagged := &am.Measurement{Name: "gorets"}
+	if withOrigin(untagged, nil).Tags != nil {
+		t.Errorf("Expected no tags, got %v", untagged.Tags)
+	}
+}
@@ -36,17 +36,24 @@ package statsd
 import (
 	"bytes"
 	"errors"
-	"fmt"
 	"io"
 	"log"
 	"strconv"
 	"time"
+	"unsafe"
 
 	"github.com/heroku/agentmon"
 )
 
-// Debug is likely something that can be eliminated
-// TODO(apg)
+// maxInterned is the most names, and tag sections, a Parser interns.
+// Past that, it allocates for each new one it sees.
+const maxInterned = 10000
+
+// Debug no longer does anything.
+//
+// Deprecated: Lines that fail to parse are counted, and a sample of them
+// logged, as set by Listener.MalformedLogInterval. Use Listener.Debug
+// for the rest of the listener's debug logging.
 var Debug = true
 
 // Parser contains the state necessary to parse statsd protocol messages from
@@ -57,6 +64,28 @@ type Parser struct {
 	partialReads bool
 	maxReadSize  int
 	done         bool
+	discarding   bool
+
+	// base is the whole of the array that buffer is a window into.
+	base []byte
+
+	// values holds the measurements of the line being parsed.
+	values []agentmon.Measurement
+
+	// names, and tags, intern the metric names and tag sections seen.
+	names map[string]string
+	tags  map[string]agentmon.Tags
+
+	// Events receives DogStatsD events as they are parsed. If nil,
+	// events are only counted.
+	Events EventSink
+
+	// MaxLineLength, if positive, is the longest line that will be
+	// parsed when partialReads is true. Longer lines are discarded.
+	MaxLineLength int
+
+	// errors counts, and logs, lines that fail to parse.
+	errors *parseErrors
 }
 
 // NewParser constructs a statsd parser.
@@ -74,35 +103,54 @@ func NewParser(r io.Reader, partialReads bool, maxReadSize int) *Parser {
 	}
 }
 
-// Next returns the next measurement parsed from the parser's Reader.
-func (p *Parser) Next() (*agentmon.Measurement, bool) {
+// nextLine returns the next line from the parser's Reader, without its
+// newline, and whether there may be more. The line is only valid until
+// the next call to nextLine, and is nil if only an overlong line was
+// discarded.
+func (p *Parser) nextLine() ([]byte, bool) {
 	buf := p.buffer
 
 	for {
 		line, rest := p.lineFrom(buf)
 
+		if line != nil && (p.discarding || p.tooLong(line)) {
+			// Skip the remainder of an overlong line.
+			p.discarding = false
+			buf = rest
+			p.buffer = rest
+			continue
+		}
+
 		if line != nil {
 			p.buffer = rest
-			m, _ := p.parseLine(line)
-			return m, true
+			return line, true
+		}
+
+		if p.discarding || p.tooLong(rest) {
+			// No end of line in sight, so there's no sense in buffering
+			// any more of it.
+			p.discarding = true
+			rest = rest[:0]
+			buf = rest
 		}
 
 		if p.done {
-			m, _ := p.parseLine(rest)
-			return m, false
+			p.buffer = []byte{}
+			return rest, false
 		}
 
 		idx := len(buf)
-		end := idx
-		end += p.maxReadSize
+		end := idx + p.maxReadSize
 
-		if cap(buf) >= end {
-			buf = buf[:end]
-		} else {
-			tmp := buf
-			buf = make([]byte, end)
-			copy(buf, tmp)
+		if cap(buf) < end {
+			// Move what's left to the front of the buffer, only growing
+			// it if there isn't room.
+			if cap(p.base) < end {
+				p.base = make([]byte, end)
+			}
+			buf = p.base[:copy(p.base, buf)]
 		}
+		buf = buf[:end]
 
 		n, err := p.reader.Read(buf[idx:])
 		buf = buf[:idx+n]
@@ -111,29 +159,47 @@ func (p *Parser) Next() (*agentmon.Measurement, bool) {
 				log.Printf("next: read: %s", err)
 			}
 
+			// Whatever was read is still parsed, but no more reads
+			// will be attempted.
 			p.done = true
+		}
+	}
+}
 
-			line, rest = p.lineFrom(buf)
-			if line != nil {
-				p.buffer = rest
-				m, _ := p.parseLine(line)
-				return m, len(rest) > 0
-			}
+// buffered returns true if nextLine can return a line without reading
+// first.
+func (p *Parser) buffered() bool {
+	return bytes.IndexByte(p.buffer, '\n') >= 0
+}
 
-			if len(rest) > 0 {
-				m, _ := p.parseLine(line)
-				return m, false
-			}
+// parsePacket parses each line of a complete datagram, calling fn with
+// every measurement found, as scanLine does. Unlike nextLine, it doesn't
+// read from the Parser's Reader.
+func (p *Parser) parsePacket(packet []byte, fn func(*agentmon.Measurement)) {
+	for len(packet) > 0 {
+		line := packet
+		if i := bytes.IndexByte(packet, '\n'); i >= 0 {
+			line, packet = packet[:i], packet[i+1:]
+		} else {
+			packet = nil
+		}
 
-			return nil, false
+		if len(line) == 0 {
+			continue
 		}
+
+		p.scanLine(line, fn)
 	}
 }
 
+// tooLong returns true if line is longer than the Parser allows.
+func (p *Parser) tooLong(line []byte) bool {
+	return p.partialReads && p.MaxLineLength > 0 && len(line) > p.MaxLineLength
+}
+
 func (p *Parser) lineFrom(input []byte) ([]byte, []byte) {
-	split := bytes.SplitAfterN(input, []byte("\n"), 2)
-	if len(split) == 2 {
-		return split[0][:len(split[0])-1], split[1]
+	if i := bytes.IndexByte(input, '\n'); i >= 0 {
+		return input[:i], input[i+1:]
 	}
 
 	if !p.partialReads {
@@ -143,107 +209,314 @@ func (p *Parser) lineFrom(input []byte) ([]byte, []byte) {
 		return input, []byte{}
 	}
 
-	if bytes.HasSuffix(input, []byte("\n")) {
-		return input[:len(input)-1], []byte{}
-	}
-
 	return nil, input
 }
 
-func (p *Parser) parseLine(line []byte) (*agentmon.Measurement, error) {
-	// metric name is [a-zA-Z0-9._-]+
-	name, rest, err := readMetricName(line)
+// parseLine parses all of the measurements in line. Most lines contain
+// a single measurement, but several `value|type` pairs can follow one
+// name, separated by ':'.
+func (p *Parser) parseLine(line []byte) ([]*agentmon.Measurement, error) {
+	var out []*agentmon.Measurement
+	err := p.scanLine(line, func(m *agentmon.Measurement) {
+		c := *m
+		out = append(out, &c)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to read a name from %q: %s", string(line), err)
+		return nil, err
+	}
+	return out, nil
+}
+
+// scanLine parses all of the measurements in line, as parseLine does,
+// but calls fn with each rather than returning them. The Measurement
+// passed to fn is only valid until fn returns. Once the Parser has seen
+// a name and set of tags, scanLine doesn't allocate for them again.
+//
+// If line fails to parse, the *ParseError returned is also recorded.
+func (p *Parser) scanLine(line []byte, fn func(*agentmon.Measurement)) error {
+	err := p.scan(line, fn)
+	if err == nil {
+		return nil
 	}
 
-	rest, ok := expect(rest, []byte(":"))
+	pe, ok := err.(*ParseError)
 	if !ok {
-		return nil, fmt.Errorf("expected ':' in %q", string(rest))
+		pe = &ParseError{Kind: Malformed, Err: err}
+	}
+	pe.Line = string(line)
+	p.errors.record(pe)
+	return pe
+}
+
+func (p *Parser) scan(line []byte, fn func(*agentmon.Measurement)) error {
+	switch {
+	case bytes.HasPrefix(line, []byte("_e{")):
+		m, err := p.parseEvent(line)
+		if err != nil {
+			return err
+		}
+		fn(m)
+		return nil
+	case bytes.HasPrefix(line, []byte("_sc|")):
+		m, err := parseServiceCheck(line)
+		if err != nil {
+			return err
+		}
+		fn(m)
+		return nil
 	}
 
-	rawValue, rest, err := readValue(rest)
+	// metric name is [a-zA-Z0-9._-]+
+	rawName, rest, err := readMetricName(line)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read a value from %q: %s", string(rest), err)
+		return parseError(BadName, "failed to read a name: %s", err)
 	}
 
-	rest, ok = expect(rest, []byte("|"))
+	var (
+		name = p.intern(rawName)
+		ok   bool
+	)
+
+	// Every value is parsed before any is passed on, so that a line is
+	// either accepted, or rejected, as a whole.
+	p.values = p.values[:0]
+	for len(rest) > 0 || len(p.values) == 0 {
+		rest, ok = expect(rest, []byte(":"))
+		if !ok {
+			return parseError(Malformed, "expected ':'")
+		}
+
+		p.values = append(p.values, agentmon.Measurement{})
+		rest, err = p.parseValue(&p.values[len(p.values)-1], name, rest)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range p.values {
+		fn(&p.values[i])
+	}
+	return nil
+}
+
+// parseValue parses a single `value|type` pair, along with its optional
+// sections, for the metric name into m. It stops at the ':' that
+// introduces the next pair, if any.
+func (p *Parser) parseValue(m *agentmon.Measurement, name string, rest []byte) ([]byte, error) {
+	rawValue, rest := readRawValue(rest)
+
+	rest, ok := expect(rest, []byte("|"))
 	if !ok {
-		return nil, fmt.Errorf("expected '|' in %q", string(rest))
+		return rest, parseError(Malformed, "expected '|' in %q", string(rest))
 	}
 
 	measureType, rest, err := readType(rest)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read type from %q: %s", string(rest), err)
+		return rest, parseError(UnknownType, "failed to read type from %q: %s", string(rest), err)
 	}
 
-	rawSample, rest, err := maybeReadSample(rest)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read sample from %q: %s", string(rest), err)
-	}
+	var (
+		rawSample []byte
+		tags      agentmon.Tags
+		ts        time.Time
+	)
+
+	// The remaining sections may come in any order, and are the sample
+	// rate, and the DogStatsD tag, timestamp, and container ID
+	// extensions.
+sections:
+	for len(rest) > 0 {
+		switch {
+		case bytes.HasPrefix(rest, []byte("|@")):
+			rawSample, rest, err = maybeReadSample(rest)
+			if err != nil {
+				return rest, parseError(BadSampleRate, "failed to read sample from %q: %s", string(rest), err)
+			}
 
-	if len(rest) != 0 || (len(rest) > 0 && rest[0] != '\n') {
-		return nil, fmt.Errorf("unexpected leftover (%d) %q", len(rest), rest)
+		case bytes.HasPrefix(rest, []byte("|#")):
+			var rawTags []byte
+			rawTags, rest = readRawValue(rest[2:])
+			if tags == nil {
+				tags = p.internTags(rawTags)
+			} else {
+				// Interned Tags are shared, so append to a copy.
+				tags, _ = readTags(rawTags, append(agentmon.Tags{}, tags...))
+			}
+
+		case bytes.HasPrefix(rest, []byte("|T")):
+			var secs int64
+			secs, rest, err = readTimestamp(rest[2:])
+			if err != nil {
+				return rest, parseError(BadTimestamp, "failed to read timestamp from %q: %s", string(rest), err)
+			}
+			ts = time.Unix(secs, 0)
+
+		case bytes.HasPrefix(rest, []byte("|c:")):
+			// Container IDs are accepted, but ignored.
+			_, rest = readRawValue(rest[3:])
+
+		case rest[0] == ':':
+			break sections
+
+		default:
+			return rest, parseError(Malformed, "unexpected leftover (%d) %q", len(rest), rest)
+		}
 	}
 
 	var (
-		sign   byte
-		value  float64
-		sample = float32(1.0)
+		modifier string
+		value    float64
+		member   string
+		sample   = float32(1.0)
 	)
 
+	if string(measureType) != "s" {
+		numValue, extra, err := readValue(rawValue)
+		if err != nil {
+			return rest, parseError(BadValue, "failed to read a value from %q: %s", string(rawValue), err)
+		}
+		if len(extra) > 0 {
+			return rest, parseError(BadValue, "unexpected %q after value", string(extra))
+		}
+		rawValue = numValue
+	}
+
 	// TODO: Now we've gotta do some fun stuff in regards to value checking.
 	// We might get a `g` which would make +/- OK. Not OK, in other types.
-	switch string(measureType) {
-	case "c", "ms":
-		value, err = strconv.ParseFloat(string(rawValue), 64)
+	metricType := bytesToMetricType(measureType)
+	switch metricType {
+	case agentmon.Set:
+		if len(rawValue) == 0 {
+			return rest, parseError(BadValue, "empty set member")
+		}
+		member = string(rawValue)
+
+	case agentmon.Counter, agentmon.Timer, agentmon.Histogram, agentmon.Distribution:
+		value, err = parseFloat(rawValue)
 		if err != nil {
-			return nil, fmt.Errorf("failed to ParseFloat %q: %s", string(rawValue), err)
+			return rest, parseError(BadValue, "failed to ParseFloat %q: %s", string(rawValue), err)
 		}
 
-	case "g":
-		if rawValue[0] == '-' || rawValue[0] == '+' {
-			sign = rawValue[0]
+	case agentmon.Gauge:
+		switch rawValue[0] {
+		case '-':
+			modifier = "-"
+			rawValue = rawValue[1:]
+		case '+':
+			modifier = "+"
 			rawValue = rawValue[1:]
 		}
-		value, err = strconv.ParseFloat(string(rawValue), 64)
+		value, err = parseFloat(rawValue)
 		if err != nil {
-			return nil, fmt.Errorf("failed to ParseFloat %q: %s", string(rawValue), err)
+			return rest, parseError(BadValue, "failed to ParseFloat %q: %s", string(rawValue), err)
 		}
-
-	default:
-		return nil, fmt.Errorf("unrecognized type: %q", string(measureType))
 	}
 
 	if len(rawSample) > 0 {
-		samp, err := strconv.ParseFloat(string(rawSample), 64)
+		samp, err := parseFloat(rawSample)
 		if err != nil {
-			return nil, fmt.Errorf("failed to ParseFloat %q: %s", string(rawSample), err)
+			return rest, parseError(BadSampleRate, "failed to ParseFloat %q: %s", string(rawSample), err)
+		}
+		// Values are scaled by 1/sample, so anything outside (0, 1] would
+		// make them infinite, negative, or inflated.
+		if !(samp > 0 && samp <= 1) {
+			return rest, parseError(BadSampleRate, "sample rate %q is not in (0, 1]", string(rawSample))
 		}
 		sample = float32(samp)
 	}
 
-	out := &agentmon.Measurement{
-		Name:       string(name),
-		Timestamp:  time.Now(),
-		Type:       stringToMetricType(string(measureType)),
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	*m = agentmon.Measurement{
+		Name:       name,
+		Timestamp:  ts,
+		Type:       metricType,
 		Value:      value,
 		SampleRate: sample,
+		Member:     member,
+		Tags:       tags,
+		Modifier:   modifier,
 	}
 
-	if sign > 0 {
-		out.Modifier = string([]byte{sign})
+	return rest, nil
+}
+
+// intern returns b as a string, reusing the string from the last time
+// it was seen, if any.
+func (p *Parser) intern(b []byte) string {
+	if s, ok := p.names[string(b)]; ok {
+		return s
 	}
 
-	return out, nil
+	s := string(b)
+	if len(p.names) < maxInterned {
+		if p.names == nil {
+			p.names = make(map[string]string)
+		}
+		p.names[s] = s
+	}
+	return s
 }
 
-func stringToMetricType(s string) agentmon.MetricType {
-	switch s {
+// internTags reads the DogStatsD tag section raw, reusing the Tags from
+// the last time it was seen, if any. The Tags returned must not be
+// modified.
+func (p *Parser) internTags(raw []byte) agentmon.Tags {
+	if tags, ok := p.tags[string(raw)]; ok {
+		return tags
+	}
+
+	tags, _ := readTags(raw, nil)
+	tags = tags[:len(tags):len(tags)]
+	if len(p.tags) < maxInterned {
+		if p.tags == nil {
+			p.tags = make(map[string]agentmon.Tags)
+		}
+		p.tags[string(raw)] = tags
+	}
+	return tags
+}
+
+// parseFloat parses b as a float64, without copying it to a string.
+func parseFloat(b []byte) (float64, error) {
+	if len(b) == 0 {
+		return strconv.ParseFloat("", 64)
+	}
+	return strconv.ParseFloat(unsafe.String(&b[0], len(b)), 64)
+}
+
+// readTimestamp reads a unix timestamp, in seconds, from the start of
+// buf.
+func readTimestamp(buf []byte) (int64, []byte, error) {
+	i := 0
+	for i < len(buf) && buf[i] >= '0' && buf[i] <= '9' {
+		i++
+	}
+	if i == 0 || i > 18 {
+		return 0, buf, errors.New("invalid timestamp")
+	}
+
+	var secs int64
+	for _, c := range buf[:i] {
+		secs = secs*10 + int64(c-'0')
+	}
+	return secs, buf[i:], nil
+}
+
+func bytesToMetricType(b []byte) agentmon.MetricType {
+	switch string(b) {
 	case "c":
 		return agentmon.Counter
 	case "ms":
 		return agentmon.Timer
+	case "s":
+		return agentmon.Set
+	case "h":
+		return agentmon.Histogram
+	case "d":
+		return agentmon.Distribution
 	default:
 		return agentmon.Gauge
 	}
@@ -277,7 +550,7 @@ func readType(buf []byte) ([]byte, []byte, error) {
 
 	i := 0
 	switch buf[i] {
-	case 'c', 'g':
+	case 'c', 'g', 's', 'h', 'd':
 		return buf[0:1], buf[1:], nil
 	case 'm':
 		if len(buf) > 1 && buf[1] == 's' {
@@ -288,6 +561,15 @@ func readType(buf []byte) ([]byte, []byte, error) {
 	return []byte{}, buf, errors.New("unexpected type")
 }
 
+// readRawValue reads everything up to the next '|', which for most
+// types is a number, but for sets is an arbitrary member.
+func readRawValue(buf []byte) ([]byte, []byte) {
+	if i := bytes.IndexByte(buf, '|'); i >= 0 {
+		return buf[:i], buf[i:]
+	}
+	return buf, []byte{}
+}
+
 func readValue(buf []byte) ([]byte, []byte, error) {
 	var (
 		sawdot bool
@@ -338,6 +620,34 @@ func maybeReadSample(buf []byte) ([]byte, []byte, error) {
 	return readValue(rest)
 }
 
+// readTags reads a DogStatsD tag section, such as
+// `env:prod,route:/users,canary`, up to the next '|', appending the
+// tags found to tags.
+func readTags(buf []byte, tags agentmon.Tags) (agentmon.Tags, []byte) {
+	raw, rest := readRawValue(buf)
+
+	for len(raw) > 0 {
+		var tag []byte
+		if i := bytes.IndexByte(raw, ','); i >= 0 {
+			tag, raw = raw[:i], raw[i+1:]
+		} else {
+			tag, raw = raw, nil
+		}
+
+		if len(tag) == 0 {
+			continue
+		}
+
+		if i := bytes.IndexByte(tag, ':'); i >= 0 {
+			tags = append(tags, agentmon.Tag{Key: string(tag[:i]), Value: string(tag[i+1:])})
+		} else {
+			tags = append(tags, agentmon.Tag{Key: string(tag)})
+		}
+	}
+
+	return tags, rest
+}
+
 func expect(buf []byte, xs []byte) ([]byte, bool) {
 	if len(buf) < len(xs) {
 		return []byte{}, false
@@ -351,9 +661,3 @@ func expect(buf []byte, xs []byte) ([]byte, bool) {
 	}
 	return buf[i:], true
 }
-
-func logParseFail(line []byte) {
-	if Debug {
-		log.Printf("ERROR: failed to parse line: %q\n", string(line))
-	}
-}
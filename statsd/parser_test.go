@@ -34,19 +34,41 @@ import (
 	"bytes"
 	"fmt"
 	"testing"
+	"time"
 
 	am "github.com/heroku/agentmon"
 )
 
-func testParser(t *testing.T, parser *Parser, expected []*am.Measurement) {
-	for _, exp := range expected {
-		act, more := parser.Next()
-		if act == nil && more {
-			continue
-		} else if act == nil {
-			t.Fatalf("Expected another measurement. Found nil instead")
+// parseAll returns the measurements, and parse errors, of every line
+// read by parser.
+func parseAll(parser *Parser) ([]*am.Measurement, []error) {
+	var ms []*am.Measurement
+	var errs []error
+	for {
+		line, more := parser.nextLine()
+		if len(line) > 0 {
+			err := parser.scanLine(line, func(m *am.Measurement) {
+				c := *m
+				ms = append(ms, &c)
+			})
+			if err != nil {
+				errs = append(errs, err)
+			}
 		}
+		if !more {
+			return ms, errs
+		}
+	}
+}
 
+func testParser(t *testing.T, parser *Parser, expected []*am.Measurement) {
+	actual, _ := parseAll(parser)
+	if len(actual) != len(expected) {
+		t.Fatalf("Expected %d measurements, got %d: %+v", len(expected), len(actual), actual)
+	}
+
+	for i, exp := range expected {
+		act := actual[i]
 		if exp.Name != act.Name {
 			t.Errorf("Expected name=%q, got=%q", exp.Name, act.Name)
 		}
@@ -57,10 +79,6 @@ func testParser(t *testing.T, parser *Parser, expected []*am.Measurement) {
 			t.Errorf("Expected type=%q, got=%q", exp.Type, act.Type)
 		}
 	}
-
-	if m, _ := parser.Next(); m != nil {
-		t.Errorf("Found an additional measurement: %+v", m)
-	}
 }
 
 func TestParserWithoutPartialReads(t *testing.T) {
@@ -121,6 +139,95 @@ gaugor:333|g
 	testParser(t, parser, expected)
 }
 
+func TestParserMultiValue(t *testing.T) {
+	input := bytes.NewBuffer([]byte(`gorets:1|c:2|c|@0.5:320|ms
+gaugor:333|g
+glork:1|c:2|c`))
+
+	expected := []*am.Measurement{
+		&am.Measurement{
+			Name:  "gorets",
+			Value: 1.0,
+			Type:  am.Counter,
+		},
+		&am.Measurement{
+			Name:  "gorets",
+			Value: 2.0,
+			Type:  am.Counter,
+		},
+		&am.Measurement{
+			Name:  "gorets",
+			Value: 320.0,
+			Type:  am.Timer,
+		},
+		&am.Measurement{
+			Name:  "gaugor",
+			Value: 333.0,
+			Type:  am.Gauge,
+		},
+		&am.Measurement{
+			Name:  "glork",
+			Value: 1.0,
+			Type:  am.Counter,
+		},
+		&am.Measurement{
+			Name:  "glork",
+			Value: 2.0,
+			Type:  am.Counter,
+		},
+	}
+
+	for partial, size := range map[bool]int{false: 100, true: 20} {
+		input := bytes.NewBuffer(input.Bytes())
+		parser := NewParser(input, partial, size)
+
+		testParser(t, parser, expected)
+	}
+}
+
+func TestParseMultiValue(t *testing.T) {
+	testCases := map[string][]*am.Measurement{
+		"gorets:1|c:2|c": {
+			{Name: "gorets", Value: 1.0, SampleRate: 1.0, Type: am.Counter},
+			{Name: "gorets", Value: 2.0, SampleRate: 1.0, Type: am.Counter},
+		},
+		"gorets:1|c|@0.1:320|ms|@0.5": {
+			{Name: "gorets", Value: 1.0, SampleRate: 0.1, Type: am.Counter},
+			{Name: "gorets", Value: 320.0, SampleRate: 0.5, Type: am.Timer},
+		},
+		"gaugor:+4.4|g:-1|g:333|g": {
+			{Name: "gaugor", Value: 4.4, SampleRate: 1.0, Type: am.Gauge, Modifier: "+"},
+			{Name: "gaugor", Value: 1.0, SampleRate: 1.0, Type: am.Gauge, Modifier: "-"},
+			{Name: "gaugor", Value: 333, SampleRate: 1.0, Type: am.Gauge},
+		},
+		"users:alice|s:bob|s": {
+			{Name: "users", SampleRate: 1.0, Type: am.Set, Member: "alice"},
+			{Name: "users", SampleRate: 1.0, Type: am.Set, Member: "bob"},
+		},
+	}
+
+	for input, exps := range testCases {
+		parser := &Parser{}
+		out, err := parser.parseLine([]byte(input))
+		if err != nil {
+			t.Errorf("Got unexpected error for %q: %s", input, err)
+			continue
+		}
+		if len(out) != len(exps) {
+			t.Errorf("Expected %d measurements for %q, got %d", len(exps), input, len(out))
+			continue
+		}
+
+		for i, exp := range exps {
+			got := out[i]
+			if got.Name != exp.Name || got.Value != exp.Value || got.SampleRate != exp.SampleRate ||
+				got.Type != exp.Type || got.Modifier != exp.Modifier || got.Member != exp.Member {
+				t.Errorf("Expected %+v, got %+v, in %q", *exp, *got, input)
+			}
+		}
+	}
+}
+
 func TestParse(t *testing.T) {
 	testCases := map[string]map[string]*am.Measurement{
 		"Counters": map[string]*am.Measurement{
@@ -171,17 +278,81 @@ func TestParse(t *testing.T) {
 				Modifier:   "",
 			},
 		},
+		"Distributions": map[string]*am.Measurement{
+			"payload.bytes:512|h": &am.Measurement{
+				Name:       "payload.bytes",
+				Value:      512,
+				SampleRate: 1.0,
+				Type:       am.Histogram,
+			},
+			"request.latency:0.25|d|@0.5|#env:prod": &am.Measurement{
+				Name:       "request.latency",
+				Value:      0.25,
+				SampleRate: 0.5,
+				Type:       am.Distribution,
+				Tags:       am.Tags{{Key: "env", Value: "prod"}},
+			},
+		},
+		"Tags": map[string]*am.Measurement{
+			"gorets:1|c|#env:prod,route:/users": &am.Measurement{
+				Name:       "gorets",
+				Value:      1.0,
+				SampleRate: 1.0,
+				Type:       am.Counter,
+				Tags:       am.Tags{{Key: "env", Value: "prod"}, {Key: "route", Value: "/users"}},
+			},
+			"gorets:1|c|@0.5|#canary": &am.Measurement{
+				Name:       "gorets",
+				Value:      1.0,
+				SampleRate: 0.5,
+				Type:       am.Counter,
+				Tags:       am.Tags{{Key: "canary"}},
+			},
+			"glork:320|ms|#env:prod|@0.1": &am.Measurement{
+				Name:       "glork",
+				Value:      320.0,
+				SampleRate: 0.1,
+				Type:       am.Timer,
+				Tags:       am.Tags{{Key: "env", Value: "prod"}},
+			},
+			"gaugor:333|g|#env:prod|c:83c0a99c0a54c0c187f461c7980e9b57f3f6a8b0c918c8d93df19a9de6f3fe1d": &am.Measurement{
+				Name:       "gaugor",
+				Value:      333,
+				SampleRate: 1.0,
+				Type:       am.Gauge,
+				Tags:       am.Tags{{Key: "env", Value: "prod"}},
+			},
+		},
+		"Sets": map[string]*am.Measurement{
+			"users.active:user123|s": &am.Measurement{
+				Name:       "users.active",
+				SampleRate: 1.0,
+				Type:       am.Set,
+				Member:     "user123",
+			},
+			"users.active:42|s": &am.Measurement{
+				Name:       "users.active",
+				SampleRate: 1.0,
+				Type:       am.Set,
+				Member:     "42",
+			},
+		},
 	}
 
 	for name, tests := range testCases {
 		t.Run(fmt.Sprintf("Parse for %s", name), func(t *testing.T) {
 			for input, exp := range tests {
 				parser := &Parser{}
-				out, err := parser.parseLine([]byte(input))
+				ms, err := parser.parseLine([]byte(input))
 				if err != nil {
 					t.Errorf("Got unexpected error for %q: %s", input, err)
 					continue
 				}
+				if len(ms) != 1 {
+					t.Errorf("Expected 1 measurement for %q, got %d", input, len(ms))
+					continue
+				}
+				out := ms[0]
 
 				if out.Name != exp.Name {
 					t.Errorf("Expected name=%q, got %q", exp.Name, out.Name)
@@ -198,11 +369,60 @@ func TestParse(t *testing.T) {
 				if out.Modifier != exp.Modifier {
 					t.Errorf("Expected modifier=%q, got %q", exp.Modifier, out.Modifier)
 				}
+				if out.Member != exp.Member {
+					t.Errorf("Expected member=%q, got %q", exp.Member, out.Member)
+				}
+				if out.Series().Key() != exp.Series().Key() {
+					t.Errorf("Expected tags=%v, got %v", exp.Tags, out.Tags)
+				}
 			}
 		})
 	}
 }
 
+func TestParseTimestamp(t *testing.T) {
+	parser := &Parser{}
+	ms, err := parser.parseLine([]byte("gorets:1|c|#env:prod|T1656581400:2|c"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(ms) != 2 {
+		t.Fatalf("Expected 2 measurements, got %d", len(ms))
+	}
+
+	if !ms[0].Timestamp.Equal(time.Unix(1656581400, 0)) {
+		t.Errorf("Expected the supplied timestamp, got %v", ms[0].Timestamp)
+	}
+	if len(ms[0].Tags) != 1 {
+		t.Errorf("Expected the tags to be kept, got %v", ms[0].Tags)
+	}
+	if since := time.Since(ms[1].Timestamp); since < 0 || since > time.Minute {
+		t.Errorf("Expected a value without a timestamp to be taken now, got %v", ms[1].Timestamp)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, input := range []string{
+		"gorets",
+		"gorets:1",
+		"gorets:abc|c",
+		"gorets:1x|c",
+		"gorets:|s",
+		"gorets:1|z",
+		"gorets:1|c|@",
+		"gorets:1|c|x",
+		"gorets:1|c|#env:prod|",
+		"gorets:1|c:",
+		"gorets:1|c:2",
+		"gorets:1|c:x|c",
+	} {
+		parser := &Parser{}
+		if out, err := parser.parseLine([]byte(input)); err == nil {
+			t.Errorf("Expected an error for %q, got %+v", input, out)
+		}
+	}
+}
+
 func TestParseValue(t *testing.T) {
 	for _, tc := range []struct {
 		input    string
@@ -293,6 +513,9 @@ func TestMetricType(t *testing.T) {
 		{"c", "c", "", true},
 		{"g", "g", "", true},
 		{"ms", "ms", "", true},
+		{"s", "s", "", true},
+		{"h", "h", "", true},
+		{"d", "d", "", true},
 		{"c|", "c", "|", true},
 		{"g|", "g", "|", true},
 		{"ms|", "ms", "|", true},
@@ -348,6 +571,36 @@ func TestSample(t *testing.T) {
 	}
 }
 
+func TestReadTags(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected am.Tags
+		rest     string
+	}{
+		{"", nil, ""},
+		{"env:prod", am.Tags{{Key: "env", Value: "prod"}}, ""},
+		{"env:prod,canary", am.Tags{{Key: "env", Value: "prod"}, {Key: "canary"}}, ""},
+		{"route:/users:id", am.Tags{{Key: "route", Value: "/users:id"}}, ""},
+		{"env:prod,,|@0.1", am.Tags{{Key: "env", Value: "prod"}}, "|@0.1"},
+	} {
+		out, rest := readTags([]byte(tc.input), nil)
+
+		if len(out) != len(tc.expected) {
+			t.Errorf("Expected tags=%v, got=%v, in %q", tc.expected, out, tc.input)
+		} else {
+			for i := range out {
+				if out[i] != tc.expected[i] {
+					t.Errorf("Expected tags=%v, got=%v, in %q", tc.expected, out, tc.input)
+				}
+			}
+		}
+
+		if string(rest) != tc.rest {
+			t.Errorf("Expected rest=%q, got=%q, in %q", tc.rest, string(rest), tc.input)
+		}
+	}
+}
+
 func BenchmarkParse(b *testing.B) {
 	parser := &Parser{}
 
@@ -366,3 +619,105 @@ func BenchmarkParse(b *testing.B) {
 		}
 	}
 }
+
+func TestScanLineAllocs(t *testing.T) {
+	for _, line := range [][]byte{
+		[]byte("gorets:1|c|#host:a,env:prod"),
+		[]byte("gaugor:-14.019910|g"),
+		[]byte("glork:320|ms|@0.1"),
+		[]byte("multi:1|c:2|c:320|ms"),
+	} {
+		parser := &Parser{}
+		var n int
+		count := func(m *am.Measurement) { n++ }
+
+		// The first parse interns the name, and tags.
+		if err := parser.scanLine(line, count); err != nil {
+			t.Fatalf("unexpected error for %q: %s", line, err)
+		}
+
+		allocs := testing.AllocsPerRun(100, func() {
+			parser.scanLine(line, count)
+		})
+		if allocs != 0 {
+			t.Errorf("Expected no allocations for %q, got %v", line, allocs)
+		}
+	}
+}
+
+func TestNextLineAllocs(t *testing.T) {
+	parser := NewParser(&repeatReader{data: []byte("gorets:1|c|#host:a\nglork:320|ms|@0.1\n")}, true, 64)
+	count := func(m *am.Measurement) {}
+
+	// Warm up the buffer, and the interned names.
+	for i := 0; i < 10; i++ {
+		line, _ := parser.nextLine()
+		parser.scanLine(line, count)
+	}
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		line, _ := parser.nextLine()
+		parser.scanLine(line, count)
+	})
+	if allocs != 0 {
+		t.Errorf("Expected no allocations, got %v", allocs)
+	}
+}
+
+func TestScanLineSharedTags(t *testing.T) {
+	parser := &Parser{}
+	var got []*am.Measurement
+	collect := func(m *am.Measurement) {
+		c := *m
+		got = append(got, &c)
+	}
+
+	parser.scanLine([]byte("aa:1|c|#host:a"), collect)
+	parser.scanLine([]byte("bb:1|c|#host:a|#env:prod"), collect)
+	parser.scanLine([]byte("cc:1|c|#host:a"), collect)
+
+	if len(got) != 3 {
+		t.Fatalf("Expected 3 measurements, got %d", len(got))
+	}
+	if len(got[1].Tags) != 2 {
+		t.Errorf("Expected 2 tags, got %v", got[1].Tags)
+	}
+	for _, m := range []*am.Measurement{got[0], got[2]} {
+		if len(m.Tags) != 1 || m.Tags[0] != (am.Tag{Key: "host", Value: "a"}) {
+			t.Errorf("Expected the interned tags to be left alone, got %v", m.Tags)
+		}
+	}
+}
+
+// repeatReader reads data over and over, without end.
+type repeatReader struct {
+	data []byte
+	off  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	return n, nil
+}
+
+func BenchmarkScanLine(b *testing.B) {
+	parser := &Parser{}
+	count := func(m *am.Measurement) {}
+
+	lines := [][]byte{
+		[]byte("gorets:1|c|#host:a,env:prod"),
+		[]byte("gorets:1|c|@0.1"),
+		[]byte("glork:320|ms|@0.1"),
+		[]byte("gaugor:333|g"),
+		[]byte("gaugor:+4.19910|g"),
+		[]byte("gaugor:-14.019910|g"),
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, l := range lines {
+			parser.scanLine(l, count)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/heroku/agentmon"
+)
+
+// ListenUnixgram creates a Unix datagram socket at Addr, and handles
+// each datagram received on it as it would a UDP packet. Any stale
+// socket file at Addr is removed first, and the socket file is removed
+// once ctx is cancelled.
+func (s Listener) ListenUnixgram(ctx context.Context) {
+	if err := removeStaleSocket(s.Addr); err != nil {
+		log.Fatalf("listenUnixgram: %s", err)
+	}
+
+	log.Printf("Listening on %s (unixgram)...", s.Addr)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: s.Addr, Net: "unixgram"})
+	if err != nil {
+		log.Fatalf("listenUnixgram: %s", err)
+	}
+	defer os.Remove(s.Addr)
+
+	if err := s.setSocketPermissions(); err != nil {
+		conn.Close()
+		log.Fatalf("listenUnixgram: %s", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+		os.Remove(s.Addr)
+	}()
+
+	if s.MaxPacketSize <= 0 {
+		s.MaxPacketSize = defaultMaxPacketSizeUnixgram
+	}
+	s.errors = newParseErrors(s.Stats, s.MalformedLogInterval)
+
+	if s.OriginDetection {
+		s.origins = newOriginCache()
+		s.originLoop(ctx, conn)
+		return
+	}
+	s.unixgramLoop(ctx, conn)
+}
+
+// unixgramLoop reads datagrams from conn, each parsed as a UDP packet
+// is, until ctx is cancelled.
+func (s Listener) unixgramLoop(ctx context.Context, conn *net.UnixConn) {
+	defer conn.Close()
+
+	buf := make([]byte, s.MaxPacketSize)
+	parser := &Parser{Events: s.Events, errors: s.errors}
+	sender := s.newSender()
+	add := func(m *agentmon.Measurement) {
+		sender.Add(ctx, m)
+	}
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("unixgramLoop: read: %s", err)
+			continue
+		}
+
+		parser.parsePacket(buf[:n], add)
+		sender.Flush(ctx)
+	}
+}
+
+// ListenUnix creates a Unix stream socket at Addr, and accepts
+// connections on it, which are handled as TCP connections are. Any
+// stale socket file at Addr is removed first, and the socket file is
+// removed once ctx is cancelled.
+func (s Listener) ListenUnix(ctx context.Context) {
+	if err := removeStaleSocket(s.Addr); err != nil {
+		log.Fatalf("listenUnix: %s", err)
+	}
+
+	log.Printf("Listening on %s (unix)...", s.Addr)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: s.Addr, Net: "unix"})
+	if err != nil {
+		log.Fatalf("listenUnix: %s", err)
+	}
+
+	// Closing the listener removes the socket file.
+	if err := s.setSocketPermissions(); err != nil {
+		listener.Close()
+		log.Fatalf("listenUnix: %s", err)
+	}
+
+	if s.OriginDetection {
+		s.origins = newOriginCache()
+	}
+
+	s.serveStream(ctx, listener)
+}
+
+// removeStaleSocket removes a socket file left at path by a previous
+// process. It refuses to remove anything that isn't a socket.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists, and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+// setSocketPermissions applies SocketMode, SocketOwner, and SocketGroup
+// to the socket file at Addr.
+func (s Listener) setSocketPermissions() error {
+	if s.SocketMode != 0 {
+		if err := os.Chmod(s.Addr, s.SocketMode); err != nil {
+			return err
+		}
+	}
+
+	if s.SocketOwner == "" && s.SocketGroup == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if s.SocketOwner != "" {
+		u, err := user.Lookup(s.SocketOwner)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return fmt.Errorf("unsupported uid %q for %s", u.Uid, s.SocketOwner)
+		}
+	}
+	if s.SocketGroup != "" {
+		g, err := user.LookupGroup(s.SocketGroup)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return fmt.Errorf("unsupported gid %q for %s", g.Gid, s.SocketGroup)
+		}
+	}
+
+	return os.Chown(s.Addr, uid, gid)
+}
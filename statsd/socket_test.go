@@ -0,0 +1,215 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package statsd
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/heroku/agentmon/internal/testutil"
+)
+
+func waitForFile(t *testing.T, path string, exists bool) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		_, err := os.Lstat(path)
+		if (err == nil) == exists {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Expected %s to exist=%t", path, exists)
+}
+
+func TestListenUnixgram(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "statsd.sock")
+	batches, inbox := testutil.Inbox(t, 10)
+	listener := Listener{Addr: path, Inbox: batches, SocketMode: 0600}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go listener.ListenUnixgram(ctx)
+	waitForFile(t, path, true)
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %s", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode=%v got=%v", os.FileMode(0600), fi.Mode().Perm())
+	}
+
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("gorets:1|c"))
+
+	testutil.ExpectMeasurement(t, inbox, "gorets")
+
+	cancel()
+	waitForFile(t, path, false)
+}
+
+func TestListenUnixgramLongDatagram(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "statsd.sock")
+	batches, inbox := testutil.Inbox(t, 1000)
+	listener := Listener{Addr: path, Inbox: batches}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go listener.ListenUnixgram(ctx)
+	waitForFile(t, path, true)
+
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+
+	// Longer than a UDP packet, but within what DogStatsD clients send.
+	var packet []byte
+	lines := 0
+	for len(packet) < 4*defaultMaxPacketSizeUDP {
+		packet = append(packet, "gorets:1|c\n"...)
+		lines++
+	}
+	packet = append(packet, "gaugor:333|g"...)
+	if _, err := conn.Write(packet); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+
+	for i := 0; i < lines; i++ {
+		testutil.ExpectMeasurement(t, inbox, "gorets")
+	}
+	testutil.ExpectMeasurement(t, inbox, "gaugor")
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "statsd.sock")
+
+	// Leave a stale socket behind, as a crashed process would.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	batches, inbox := testutil.Inbox(t, 10)
+	listener := Listener{Addr: path, Inbox: batches}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		listener.ListenUnix(ctx)
+		close(done)
+	}()
+
+	var conn net.Conn
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn, err = net.Dial("unix", path)
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("gorets:1|c\ngaugor:333|g\n"))
+
+	testutil.ExpectMeasurement(t, inbox, "gorets")
+	testutil.ExpectMeasurement(t, inbox, "gaugor")
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected listener to stop after cancellation")
+	}
+	waitForFile(t, path, false)
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := removeStaleSocket(filepath.Join(dir, "missing.sock")); err != nil {
+		t.Errorf("Got unexpected error for a missing file: %s", err)
+	}
+
+	regular := filepath.Join(dir, "regular")
+	if err := os.WriteFile(regular, []byte("keep me"), 0644); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := removeStaleSocket(regular); err == nil {
+		t.Errorf("Expected an error for a regular file")
+	}
+	if _, err := os.Stat(regular); err != nil {
+		t.Errorf("Regular file should not have been removed: %s", err)
+	}
+}
+
+func TestSetSocketPermissionsOwnership(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("current user: %s", err)
+	}
+	g, err := user.LookupGroupId(u.Gid)
+	if err != nil {
+		t.Skipf("current group: %s", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "statsd.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+
+	listener := Listener{Addr: path, SocketOwner: u.Username, SocketGroup: g.Name}
+	if err := listener.setSocketPermissions(); err != nil {
+		t.Errorf("Got unexpected error: %s", err)
+	}
+
+	listener.SocketOwner = "no-such-user-agentmon"
+	if err := listener.setSocketPermissions(); err == nil {
+		t.Errorf("Expected an error for an unknown user")
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package statsd
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/heroku/agentmon"
+)
+
+// batchReader reads up to len(bufs) datagrams at once, storing the
+// size of each in sizes and returning how many were read.
+type batchReader interface {
+	ReadBatch(bufs [][]byte, sizes []int) (int, error)
+}
+
+// singleReader is a batchReader that reads one datagram at a time.
+type singleReader struct {
+	conn *net.UDPConn
+}
+
+func (r singleReader) ReadBatch(bufs [][]byte, sizes []int) (int, error) {
+	n, err := r.conn.Read(bufs[0])
+	if err != nil {
+		return 0, err
+	}
+	sizes[0] = n
+	return 1, nil
+}
+
+// ListenUDP reads statsd datagrams sent to Addr until ctx is cancelled.
+// With more than one Reader, each gets its own socket and the kernel
+// spreads datagrams across them.
+func (s Listener) ListenUDP(ctx context.Context) {
+	conns, err := s.listenUDP()
+	if err != nil {
+		log.Fatalf("listenUDP: %s", err)
+	}
+
+	log.Printf("Listening on %s (%d readers)...", conns[0].LocalAddr(), len(conns))
+	s.serveUDP(ctx, conns)
+}
+
+// listenUDP opens Readers sockets bound to Addr.
+func (s Listener) listenUDP() ([]*net.UDPConn, error) {
+	readers := s.Readers
+	if readers < 1 {
+		readers = 1
+	}
+	if readers > 1 && !reusePortSupported {
+		log.Printf("listenUDP: multiple readers aren't supported on this platform, using 1")
+		readers = 1
+	}
+
+	var lc net.ListenConfig
+	if readers > 1 {
+		lc.Control = reusePort
+	}
+
+	addr := s.Addr
+	conns := make([]*net.UDPConn, 0, readers)
+	for i := 0; i < readers; i++ {
+		pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+
+		conn := pc.(*net.UDPConn)
+		if s.ReceiveBuffer > 0 {
+			if err := conn.SetReadBuffer(s.ReceiveBuffer); err != nil {
+				log.Printf("listenUDP: set receive buffer: %s", err)
+			}
+		}
+
+		// Bind the rest to the same port, in case Addr asked for any.
+		addr = conn.LocalAddr().String()
+		conns = append(conns, conn)
+	}
+
+	return conns, nil
+}
+
+// serveUDP runs a datagramLoop per connection, returning once all of
+// them have.
+func (s Listener) serveUDP(ctx context.Context, conns []*net.UDPConn) {
+	s.errors = newParseErrors(s.Stats, s.MalformedLogInterval)
+
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn *net.UDPConn) {
+			defer wg.Done()
+			s.datagramLoop(ctx, conn)
+		}(conn)
+	}
+	wg.Wait()
+}
+
+// datagramLoop reads batches of datagrams from conn, sending what they
+// contain to the Inbox, until ctx is cancelled.
+func (s Listener) datagramLoop(ctx context.Context, conn *net.UDPConn) {
+	defer conn.Close()
+
+	if s.MaxPacketSize <= 0 {
+		s.MaxPacketSize = defaultMaxPacketSizeUDP
+	}
+	if s.MaxPacketSize > maxPacketSizeUDP {
+		s.MaxPacketSize = maxPacketSizeUDP
+	}
+	if s.BatchSize <= 0 {
+		s.BatchSize = defaultBatchSizeUDP
+	}
+
+	bufs := make([][]byte, s.BatchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, s.MaxPacketSize)
+	}
+	sizes := make([]int, s.BatchSize)
+
+	reader, err := newBatchReader(conn, s.BatchSize)
+	if err != nil {
+		log.Printf("datagramLoop: %s, reading one datagram at a time", err)
+		reader = singleReader{conn}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	parser := &Parser{Events: s.Events, errors: s.errors}
+	sender := s.newSender()
+	add := func(m *agentmon.Measurement) {
+		sender.Add(ctx, m)
+	}
+
+	for {
+		n, err := reader.ReadBatch(bufs, sizes)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("datagramLoop: read: %s", err)
+			continue
+		}
+
+		if s.Debug {
+			log.Printf("debug: read %d statsd datagrams", n)
+		}
+
+		for i := 0; i < n; i++ {
+			parser.parsePacket(bufs[i][:sizes[i]], add)
+		}
+		sender.Flush(ctx)
+	}
+}
@@ -0,0 +1,378 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	am "github.com/heroku/agentmon"
+	"github.com/heroku/agentmon/internal/testutil"
+)
+
+func startUDP(tb testing.TB, listener Listener) (string, context.CancelFunc, *sync.WaitGroup) {
+	listener.Addr = "127.0.0.1:0"
+	conns, err := listener.listenUDP()
+	if err != nil {
+		tb.Fatalf("listen: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		listener.serveUDP(ctx, conns)
+	}()
+
+	return conns[0].LocalAddr().String(), cancel, &wg
+}
+
+func TestListenUDP(t *testing.T) {
+	batches, inbox := testutil.Inbox(t, 10)
+	addr, cancel, wg := startUDP(t, Listener{Inbox: batches})
+	defer wg.Wait()
+	defer cancel()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("aa:1|c\nbb:2|g\n\ncc:3|c"))
+	testutil.ExpectMeasurement(t, inbox, "aa")
+	testutil.ExpectMeasurement(t, inbox, "bb")
+	testutil.ExpectMeasurement(t, inbox, "cc")
+}
+
+func TestListenUDPTransform(t *testing.T) {
+	templates, err := am.ParseTemplates([]string{"app.process.measurement*"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	batches, inbox := testutil.Inbox(t, 10)
+	addr, cancel, wg := startUDP(t, Listener{Inbox: batches, Transform: templates})
+	defer wg.Wait()
+	defer cancel()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("web.1.requests:1|c\n_e{5,4}:title|text"))
+	testutil.ExpectMeasurement(t, inbox, "requests")
+	m := testutil.ExpectMeasurement(t, inbox, EventsMetricName)
+	if len(m.Tags) != 1 || m.Tags[0].Key != "alert_type" {
+		t.Errorf("expected only the alert_type tag, got %v", m.Tags)
+	}
+}
+
+func TestListenUDPValues(t *testing.T) {
+	batches, inbox := testutil.Inbox(t, 10)
+	addr, cancel, wg := startUDP(t, Listener{Inbox: batches})
+	defer wg.Wait()
+	defer cancel()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("gorets:1|c\ngorets:1|c|@0.1\ngaugor:333|g\n"))
+	for _, exp := range []am.Measurement{
+		{Name: "gorets", Value: 1, Type: am.Counter, SampleRate: 1},
+		{Name: "gorets", Value: 1, Type: am.Counter, SampleRate: 0.1},
+		{Name: "gaugor", Value: 333, Type: am.Gauge, SampleRate: 1},
+	} {
+		m := testutil.ExpectMeasurement(t, inbox, exp.Name)
+		if m.Value != exp.Value || m.Type != exp.Type || m.SampleRate != exp.SampleRate {
+			t.Errorf("Expected %+v, got %+v", exp, *m)
+		}
+	}
+}
+
+func TestListenUDPReaders(t *testing.T) {
+	batches, inbox := testutil.Inbox(t, 1000)
+	listener := Listener{Inbox: batches, Readers: 4, BatchSize: 8, ReceiveBuffer: 1 << 20}
+	addr, cancel, wg := startUDP(t, listener)
+	defer wg.Wait()
+	defer cancel()
+
+	// Several senders, so that SO_REUSEPORT has reason to use more
+	// than one socket.
+	const senders, packets = 8, 50
+	for i := 0; i < senders; i++ {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatalf("dial: %s", err)
+		}
+		defer conn.Close()
+
+		for j := 0; j < packets; j++ {
+			conn.Write([]byte("aa:1|c"))
+		}
+	}
+
+	for i := 0; i < senders*packets; i++ {
+		testutil.ExpectMeasurement(t, inbox, "aa")
+	}
+}
+
+func TestListenUDPJumbo(t *testing.T) {
+	batches, inbox := testutil.Inbox(t, 1000)
+	addr, cancel, wg := startUDP(t, Listener{Inbox: batches, MaxPacketSize: 1 << 20})
+	defer wg.Wait()
+	defer cancel()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+
+	var b strings.Builder
+	for b.Len() < 8000 {
+		fmt.Fprintf(&b, "m%d:1|c\n", b.Len())
+	}
+	b.WriteString("last:1|c")
+	if _, err := conn.Write([]byte(b.String())); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case m := <-inbox:
+			if m.Name == "last" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Expected the whole jumbo datagram to be parsed")
+		}
+	}
+}
+
+func TestListenUDPMalformed(t *testing.T) {
+	batches, inbox := testutil.Inbox(t, 10)
+	stats := am.NewStats()
+	addr, cancel, wg := startUDP(t, Listener{Inbox: batches, Stats: stats})
+	defer wg.Wait()
+	defer cancel()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("aa:x|c\nbb:1|q\ncc:1|c"))
+	testutil.ExpectMeasurement(t, inbox, "cc")
+
+	for _, kind := range []ParseErrorKind{BadValue, UnknownType} {
+		c := stats.Counter(MalformedMetricName, am.Tag{Key: "kind", Value: kind.String()})
+		if c.Value() != 1 {
+			t.Errorf("Expected 1 %s line, got %d", kind, c.Value())
+		}
+	}
+}
+
+func TestListenUDPCancel(t *testing.T) {
+	_, cancel, wg := startUDP(t, Listener{Inbox: make(chan *am.Batch), Readers: 2})
+
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected serveUDP to return once cancelled")
+	}
+}
+
+func TestListenUDPCancelBlocked(t *testing.T) {
+	addr, cancel, wg := startUDP(t, Listener{Inbox: make(chan *am.Batch)})
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("gorets:1|c\ngaugor:333|g\n"))
+
+	// Nothing reads the Inbox, so the datagramLoop is stuck until
+	// cancelled.
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected serveUDP to return once cancelled")
+	}
+}
+
+// benchmarkUDP sends b.N datagrams of 10 lines each over loopback,
+// spread across several senders so that SO_REUSEPORT has more than one
+// flow to balance. Sending is paced so the receive buffers never
+// overflow, making ns/op the cost of receiving and parsing a datagram.
+func benchmarkUDP(b *testing.B, listener Listener) {
+	const lines, senders, window = 10, 8, 256
+
+	inbox := make(chan *am.Batch, 64)
+	listener.Inbox = inbox
+	listener.ReceiveBuffer = 4 << 20
+	addr, cancel, wg := startUDP(b, listener)
+	defer wg.Wait()
+	defer cancel()
+
+	var received int64
+	go func() {
+		for batch := range inbox {
+			atomic.AddInt64(&received, int64(batch.Len()))
+			batch.Release()
+		}
+	}()
+
+	conns := make([]net.Conn, senders)
+	for i := range conns {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			b.Fatalf("dial: %s", err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+
+	var packet strings.Builder
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&packet, "bench.metric%d:%d|c|#host:a\n", i, i)
+	}
+	payload := []byte(packet.String())
+
+	waitFor := func(want int64) {
+		for deadline := time.Now().Add(time.Second); atomic.LoadInt64(&received) < want; {
+			if time.Now().After(deadline) {
+				b.Fatalf("Expected %d measurements, got %d", want, atomic.LoadInt64(&received))
+			}
+			runtime.Gosched()
+		}
+	}
+
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conns[i%senders].Write(payload)
+		if i >= window {
+			waitFor(int64((i - window) * lines))
+		}
+	}
+	waitFor(int64(b.N * lines))
+}
+
+func BenchmarkListenUDP(b *testing.B) {
+	for _, bc := range []struct {
+		readers, batch int
+	}{
+		{1, 1},
+		{1, 32},
+		{4, 1},
+		{4, 32},
+	} {
+		b.Run(fmt.Sprintf("readers=%d/batch=%d", bc.readers, bc.batch), func(b *testing.B) {
+			benchmarkUDP(b, Listener{Readers: bc.readers, BatchSize: bc.batch})
+		})
+	}
+}
+
+// BenchmarkParsePacket measures what the datagramLoop does with each
+// datagram, without the socket.
+func BenchmarkParsePacket(b *testing.B) {
+	var input strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&input, "bench.metric%d:%d|c\n", i%10, i)
+	}
+	packet := []byte(input.String())
+
+	inbox := make(chan *am.Batch, 64)
+	done := make(chan struct{})
+	var received int
+	go func() {
+		for batch := range inbox {
+			received += batch.Len()
+			batch.Release()
+		}
+		close(done)
+	}()
+
+	ctx := context.Background()
+	parser := &Parser{}
+	sender := Listener{Inbox: inbox}.newSender()
+	add := func(m *am.Measurement) {
+		sender.Add(ctx, m)
+	}
+
+	b.SetBytes(int64(len(packet)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		parser.parsePacket(packet, add)
+		sender.Flush(ctx)
+	}
+	close(inbox)
+	<-done
+	b.StopTimer()
+
+	if received != b.N*1000 {
+		b.Fatalf("Expected %d measurements, got %d", b.N*1000, received)
+	}
+	b.ReportMetric(float64(received)/b.Elapsed().Seconds(), "measurements/s")
+}
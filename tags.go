@@ -0,0 +1,83 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agentmon
+
+import (
+	"sort"
+	"strings"
+)
+
+// Tag is a key/value pair that further identifies a metric. A Tag may
+// have an empty Value, in which case only its Key is meaningful.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Tags is a set of Tag, in no particular order.
+type Tags []Tag
+
+// Sorted returns a copy of the Tags, sorted by Key, and then Value.
+func (t Tags) Sorted() Tags {
+	out := make(Tags, len(t))
+	copy(out, t)
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Key == out[j].Key {
+			return out[i].Value < out[j].Value
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
+
+// Series identifies a metric by its name and tags.
+type Series struct {
+	Name string
+	Tags Tags
+}
+
+// Key returns a string that uniquely identifies the Series regardless
+// of the order of its Tags. A Series without Tags is keyed by its Name.
+func (s Series) Key() string {
+	if len(s.Tags) == 0 {
+		return s.Name
+	}
+
+	var b strings.Builder
+	b.WriteString(s.Name)
+	for _, t := range s.Tags.Sorted() {
+		b.WriteByte(0)
+		b.WriteString(t.Key)
+		b.WriteByte(1)
+		b.WriteString(t.Value)
+	}
+	return b.String()
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agentmon
+
+import "testing"
+
+func TestSeriesKey(t *testing.T) {
+	a := Series{Name: "foo", Tags: Tags{{"b", "2"}, {"a", "1"}}}
+	b := Series{Name: "foo", Tags: Tags{{"a", "1"}, {"b", "2"}}}
+	c := Series{Name: "foo", Tags: Tags{{"a", "1"}}}
+
+	if a.Key() != b.Key() {
+		t.Errorf("tag order should not matter: %q != %q", a.Key(), b.Key())
+	}
+	if a.Key() == c.Key() {
+		t.Errorf("different tags should produce different keys: %q", a.Key())
+	}
+	if got := (Series{Name: "foo"}).Key(); got != "foo" {
+		t.Errorf("got %q, want %q", got, "foo")
+	}
+}
+
+func TestTagsSorted(t *testing.T) {
+	tags := Tags{{"b", "2"}, {"a", "2"}, {"a", "1"}}
+	got := tags.Sorted()
+	want := Tags{{"a", "1"}, {"a", "2"}, {"b", "2"}}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("at %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+	if tags[0].Key != "b" {
+		t.Errorf("Sorted should not modify the original Tags: %v", tags)
+	}
+}
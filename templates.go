@@ -0,0 +1,253 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agentmon
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Transformer rewrites a Measurement before it's added to a MetricSet.
+type Transformer interface {
+	Transform(m *Measurement)
+}
+
+// Template turns a dotted metric name into a base name and tags, in the
+// style of Graphite templates. For example, the template
+// `app.process.index.measurement.status` turns
+// `app.web.1.requests.200` into `requests`, tagged with app=app,
+// process=web, index=1, and status=200.
+//
+// Each part of the template names what the corresponding part of the
+// metric name becomes: `measurement` parts are joined, with '.', into
+// the base name, `measurement*` takes the rest of the name, empty parts
+// are skipped, and every other part is the key of a tag.
+type Template struct {
+	// Filter, if set, restricts the Template to names that it matches.
+	// It's matched a dotted part at a time, each part as with
+	// path.Match, and names may have more parts than Filter does.
+	Filter string
+
+	// Parts of the template.
+	Parts []string
+
+	// Tags are added to every Measurement the Template matches, unless
+	// it's already tagged with the same Key.
+	Tags Tags
+}
+
+// ParseTemplate parses a template of the form `[filter] template
+// [tag=value,...]`.
+func ParseTemplate(s string) (Template, error) {
+	var t Template
+	fields := strings.Fields(s)
+
+	switch len(fields) {
+	case 1:
+		t.Parts = strings.Split(fields[0], ".")
+	case 2:
+		if strings.Contains(fields[1], "=") {
+			t.Parts = strings.Split(fields[0], ".")
+			t.Tags = parseTemplateTags(fields[1])
+		} else {
+			t.Filter = fields[0]
+			t.Parts = strings.Split(fields[1], ".")
+		}
+	case 3:
+		t.Filter = fields[0]
+		t.Parts = strings.Split(fields[1], ".")
+		t.Tags = parseTemplateTags(fields[2])
+	default:
+		return t, fmt.Errorf("expected `[filter] template [tags]`, got %q", s)
+	}
+
+	if _, err := path.Match(t.Filter, ""); err != nil {
+		return t, fmt.Errorf("invalid filter %q: %s", t.Filter, err)
+	}
+	for _, tag := range t.Tags {
+		if tag.Key == "" || tag.Value == "" {
+			return t, fmt.Errorf("invalid tags in %q", s)
+		}
+	}
+
+	measured := false
+	for i, part := range t.Parts {
+		switch part {
+		case "measurement":
+			measured = true
+		case "measurement*":
+			if i != len(t.Parts)-1 {
+				return t, fmt.Errorf("measurement* must come last in %q", s)
+			}
+			measured = true
+		}
+	}
+	if !measured {
+		return t, fmt.Errorf("no measurement in %q", s)
+	}
+	return t, nil
+}
+
+func parseTemplateTags(s string) Tags {
+	var tags Tags
+	for _, pair := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(pair, "=")
+		tags = append(tags, Tag{Key: k, Value: v})
+	}
+	return tags
+}
+
+// MatchName matches pattern against the leading dotted parts of name,
+// a part at a time with path.Match. An empty pattern matches any name.
+// rest is what's left of name after the matched parts, starting with
+// its dot, so it's empty when pattern matched all of name.
+func MatchName(pattern, name string) (rest string, ok bool) {
+	if pattern == "" {
+		return name, true
+	}
+
+	patterns := strings.Split(pattern, ".")
+	parts := strings.SplitN(name, ".", len(patterns)+1)
+	if len(parts) < len(patterns) {
+		return "", false
+	}
+
+	n := len(patterns) - 1
+	for i, p := range patterns {
+		if ok, _ := path.Match(p, parts[i]); !ok {
+			return "", false
+		}
+		n += len(parts[i])
+	}
+	return name[n:], true
+}
+
+// Matches returns true if name matches the Template's Filter, and has
+// enough parts to reach every measurement part of the Template.
+func (t Template) Matches(name string) bool {
+	if strings.Count(name, ".") < t.lastMeasurement() {
+		return false
+	}
+	_, ok := MatchName(t.Filter, name)
+	return ok
+}
+
+// lastMeasurement returns the index of the Template's last measurement
+// part.
+func (t Template) lastMeasurement() int {
+	last := 0
+	for i, part := range t.Parts {
+		if part == "measurement" || part == "measurement*" {
+			last = i
+		}
+	}
+	return last
+}
+
+// Apply rewrites the Name of m, and adds to its Tags, according to the
+// Template. Tags m already has are kept. Names too short to reach every
+// measurement part of the Template are left alone.
+func (t Template) Apply(m *Measurement) {
+	parts := strings.Split(m.Name, ".")
+	if len(parts) <= t.lastMeasurement() {
+		return
+	}
+
+	var (
+		measurement []string
+		tags        = make(Tags, len(m.Tags), len(m.Tags)+len(t.Parts)+len(t.Tags))
+	)
+	copy(tags, m.Tags)
+
+	for i, part := range t.Parts {
+		if i >= len(parts) {
+			break
+		}
+
+		switch part {
+		case "":
+		case "measurement":
+			measurement = append(measurement, parts[i])
+		case "measurement*":
+			measurement = append(measurement, parts[i:]...)
+		default:
+			tags = tags.with(Tag{Key: part, Value: parts[i]})
+		}
+	}
+	for _, tag := range t.Tags {
+		tags = tags.with(tag)
+	}
+
+	if len(measurement) > 0 {
+		m.Name = strings.Join(measurement, ".")
+	}
+	if len(tags) > 0 {
+		m.Tags = tags
+	}
+}
+
+// with appends tag, unless there's already a Tag with its Key.
+func (t Tags) with(tag Tag) Tags {
+	for _, have := range t {
+		if have.Key == tag.Key {
+			return t
+		}
+	}
+	return append(t, tag)
+}
+
+// Templates is a list of Template, of which the first to match a
+// Measurement's Name is applied to it.
+type Templates []Template
+
+// ParseTemplates parses each of specs with ParseTemplate.
+func ParseTemplates(specs []string) (Templates, error) {
+	out := make(Templates, 0, len(specs))
+	for _, spec := range specs {
+		t, err := ParseTemplate(spec)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// Transform applies the first Template to match m's Name, if any.
+func (ts Templates) Transform(m *Measurement) {
+	for _, t := range ts {
+		if t.Matches(m.Name) {
+			t.Apply(m)
+			return
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2017, Heroku Inc <metrics-feedback@heroku.com>.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// * Redistributions of source code must retain the above copyright
+//   notice, this list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright
+//   notice, this list of conditions and the following disclaimer in the
+//   documentation and/or other materials provided with the distribution.
+//
+// * The names of its contributors may not be used to endorse or promote
+//   products derived from this software without specific prior written
+//   permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package agentmon
+
+import (
+	"testing"
+)
+
+func TestParseTemplate(t *testing.T) {
+	for _, tc := range []struct {
+		spec   string
+		filter string
+		parts  int
+		tags   int
+	}{
+		{"app.process.index.measurement.status", "", 5, 0},
+		{"app.* app.process.measurement*", "app.*", 3, 0},
+		{"app.process.measurement* region=us,env=prod", "", 3, 2},
+		{"app.* app.process.measurement* region=us", "app.*", 3, 1},
+	} {
+		tmpl, err := ParseTemplate(tc.spec)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %s", tc.spec, err)
+			continue
+		}
+		if tmpl.Filter != tc.filter || len(tmpl.Parts) != tc.parts || len(tmpl.Tags) != tc.tags {
+			t.Errorf("Unexpected template for %q: %+v", tc.spec, tmpl)
+		}
+	}
+
+	for _, spec := range []string{
+		"",
+		"app.process.index",
+		"app.measurement*.status",
+		"[ app.measurement",
+		"app.measurement region",
+		"a b c d",
+	} {
+		if _, err := ParseTemplate(spec); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
+
+func TestMatchName(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, name, rest string
+		ok                  bool
+	}{
+		{"", "web.requests", "web.requests", true},
+		{"*.requests", "web.requests", "", true},
+		{"*.requests", "web.requests.count", ".count", true},
+		{"*.requests", "web.", "", false},
+		{"*.requests.*", "web.requests", "", false},
+		{"web.req*", "web.requests", "", true},
+		{"*", "web.", ".", true},
+		{"api", "web.requests", "", false},
+	} {
+		rest, ok := MatchName(tc.pattern, tc.name)
+		if rest != tc.rest || ok != tc.ok {
+			t.Errorf("MatchName(%q, %q) = %q, %t, want %q, %t", tc.pattern, tc.name, rest, ok, tc.rest, tc.ok)
+		}
+	}
+}
+
+func TestTemplatesTransform(t *testing.T) {
+	templates, err := ParseTemplates([]string{
+		"app.*.*.requests.* app.process.index.measurement.status",
+		"app.* app.process.measurement* region=us",
+		"measurement.measurement.host",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		tags     Tags
+		expected Series
+	}{
+		{
+			name: "app.web.1.requests.200",
+			expected: Series{Name: "requests", Tags: Tags{
+				{Key: "app", Value: "app"}, {Key: "process", Value: "web"},
+				{Key: "index", Value: "1"}, {Key: "status", Value: "200"},
+			}},
+		},
+		{
+			name: "app.worker.jobs.done",
+			expected: Series{Name: "jobs.done", Tags: Tags{
+				{Key: "app", Value: "app"}, {Key: "process", Value: "worker"}, {Key: "region", Value: "us"},
+			}},
+		},
+		{
+			name: "app.worker.jobs",
+			tags: Tags{{Key: "region", Value: "eu"}},
+			expected: Series{Name: "jobs", Tags: Tags{
+				{Key: "app", Value: "app"}, {Key: "process", Value: "worker"}, {Key: "region", Value: "eu"},
+			}},
+		},
+		{
+			name:     "cpu.load.host1",
+			expected: Series{Name: "cpu.load", Tags: Tags{{Key: "host", Value: "host1"}}},
+		},
+		{
+			name:     "load",
+			expected: Series{Name: "load"},
+		},
+	} {
+		m := &Measurement{Name: tc.name, Tags: tc.tags}
+		templates.Transform(m)
+		if m.Series().Key() != tc.expected.Key() {
+			t.Errorf("Expected %+v for %s, got %+v", tc.expected, tc.name, m.Series())
+		}
+	}
+}
+
+func TestTemplateTooFewParts(t *testing.T) {
+	tmpl, err := ParseTemplate("app.measurement region=us")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if tmpl.Matches("x") {
+		t.Error("Expected a name too short for the template not to match")
+	}
+
+	m := &Measurement{Name: "x"}
+	tmpl.Apply(m)
+	if m.Name != "x" || len(m.Tags) != 0 {
+		t.Errorf("Expected x to be left alone, got %+v", m.Series())
+	}
+}
+
+func TestTemplateApplyKeepsTags(t *testing.T) {
+	tags := make(Tags, 1, 4)
+	tags[0] = Tag{Key: "host", Value: "a"}
+	shared := tags[:2]
+
+	tmpl, _ := ParseTemplate("process.measurement")
+	m := &Measurement{Name: "web.requests", Tags: tags}
+	tmpl.Apply(m)
+
+	if shared[1] != (Tag{}) {
+		t.Errorf("Expected the original Tags to be left alone, got %v", shared)
+	}
+	if len(m.Tags) != 2 {
+		t.Errorf("Expected 2 tags, got %v", m.Tags)
+	}
+}